@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gocount/internal/build"
+	"gocount/internal/cgroups"
+	"gocount/internal/container"
+	"gocount/internal/image"
+	"gocount/internal/network"
+	"gocount/internal/paths"
+	"gocount/internal/rootfs"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagBuildFile    string
+	flagBuildTag     string
+	flagBuildNoCache bool
+)
+
+var buildCmd = &cobra.Command{
+	Use:   "build [context]",
+	Short: "Build an image from a Gocountfile",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if flagBuildTag == "" {
+			fmt.Println("Error: an image name is required (-t name:tag)")
+			os.Exit(1)
+		}
+
+		file := flagBuildFile
+		if file == "" {
+			file = filepath.Join(args[0], "Gocountfile")
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		instructions, err := build.Parse(f)
+		f.Close()
+		if err != nil {
+			fmt.Println("Error parsing", file+":", err)
+			os.Exit(1)
+		}
+
+		b := &build.Builder{
+			ContextDir: args[0],
+			Run:        runBuildStep,
+			NoCache:    flagBuildNoCache,
+			Out:        os.Stdout,
+		}
+		img, err := b.Build(instructions, flagBuildTag)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Successfully built", img.Name, img.ID[:12])
+	},
+}
+
+// runBuildStep runs a RUN instruction in a throwaway container on top of the
+// layers built so far
+func runBuildStep(lowerDirs []string, config image.Config, cmdline []string) (string, func(), error) {
+	id := container.GenerateID()
+	dir := filepath.Join(paths.Root, id)
+	c := &container.Container{
+		ID:        id,
+		Command:   cmdline,
+		RootFs:    dir + "/rootfs",
+		LowerDirs: lowerDirs,
+		UpperDir:  dir + "/upper",
+		WorkDir:   dir + "/work",
+		Rootless:  paths.Rootless(),
+	}
+	c.Network = network.DefaultMode(c.Rootless)
+	c.Capabilities = container.DefaultCapabilities
+	if c.Rootless {
+		c.UIDMap, c.GIDMap = container.RootlessIDMaps()
+	}
+
+	cleanup := func() {
+		network.CleanupContainerNetwork(id)
+		if err := rootfs.Unmount(c.RootFs); err != nil {
+			fmt.Println("Warning:", err)
+		}
+		cgroups.Delete(id)
+		os.RemoveAll(dir)
+	}
+
+	if err := c.PrepareRootfs(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	cgPath, err := cgroups.Create(id)
+	if err != nil && !c.Rootless {
+		cleanup()
+		return "", nil, err
+	}
+	if err != nil {
+		fmt.Println("Warning: no cgroup for build step:", err)
+	} else if err := cgroups.SetDevices(cgPath, c.DeviceRules()); err != nil {
+		fmt.Println("Warning: cannot restrict devices:", err)
+	}
+	c.Cgroup = cgPath
+
+	c.Env = container.MergeEnv(container.DefaultEnv(id), config.Env)
+	c.WorkingDir = config.WorkingDir
+	if c.Ulimits, err = defaultUlimits(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	command := newChildCommand(c)
+	command.Stdin = nil
+
+	if err := startChild(c, command); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	stopNetwork, err := network.Setup(c.Network, id, command.Process.Pid)
+	if err != nil {
+		fmt.Println("Warning: network setup failed:", err)
+	}
+	defer stopNetwork()
+	if err := command.Wait(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("%v: %v", cmdline, err)
+	}
+
+	return c.UpperDir, cleanup, nil
+}
+
+func init() {
+	buildCmd.Flags().StringVarP(&flagBuildFile, "file", "f", "", "Path to the Gocountfile (default <context>/Gocountfile)")
+	buildCmd.Flags().StringVarP(&flagBuildTag, "tag", "t", "", "Name of the resulting image (name:tag)")
+	buildCmd.Flags().BoolVar(&flagBuildNoCache, "no-cache", false, "Do not use cached layers")
+
+	rootCmd.AddCommand(buildCmd)
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"gocount/internal/container"
+	"gocount/internal/rootfs"
+
+	"github.com/spf13/cobra"
+)
+
+var flagCacheCleanAll bool
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the shared rootfs cache",
+}
+
+var cacheLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List cached rootfs archives and trees",
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := rootfs.ListCache()
+		if err != nil {
+			fmt.Println("Error loading cache:", err)
+			return
+		}
+		lowerDirs := containerLowerDirs()
+
+		fmt.Println("SHA256\tSIZE\tUSED\tCREATED\tURL")
+		for _, e := range entries {
+			created := "-"
+			if !e.Created.IsZero() {
+				created = e.Created.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%s\t%s\t%v\t%s\t%s\n", e.SHA256[:12], formatBytes(strconv.FormatInt(e.Size(), 10)), e.InUse(lowerDirs), created, e.URL)
+		}
+	},
+}
+
+var cacheCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove cached rootfs trees no container uses",
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := rootfs.ListCache()
+		if err != nil {
+			fmt.Println("Error loading cache:", err)
+			os.Exit(1)
+		}
+		lowerDirs := containerLowerDirs()
+
+		var freed int64
+		for _, e := range entries {
+			if e.InUse(lowerDirs) && !flagCacheCleanAll {
+				continue
+			}
+			size := e.Size()
+			if err := e.Remove(); err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			freed += size
+			fmt.Println("Removed", e.SHA256[:12])
+		}
+		fmt.Println("Freed", formatBytes(strconv.FormatInt(freed, 10)))
+	},
+}
+
+// containerLowerDirs returns the lower dirs of every known container
+func containerLowerDirs() []string {
+	containers, _ := container.LoadContainers()
+	var dirs []string
+	for _, c := range containers {
+		dirs = append(dirs, c.LowerDirs...)
+	}
+	return dirs
+}
+
+func init() {
+	cacheCleanCmd.Flags().BoolVar(&flagCacheCleanAll, "all", false, "Also remove entries used by existing containers")
+
+	cacheCmd.AddCommand(cacheLsCmd)
+	cacheCmd.AddCommand(cacheCleanCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gocount/internal/cgroups"
+	"gocount/internal/container"
+	"gocount/internal/image"
+	"gocount/internal/rootfs"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagCommitAuthor  string
+	flagCommitMessage string
+	flagCommitChanges []string
+	flagCommitPause   bool
+)
+
+var commitCmd = &cobra.Command{
+	Use:   "commit [container_id] [name:tag]",
+	Short: "Create a new image from a container's changes",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := container.Lookup(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		base, err := commitBase(c)
+		if err != nil {
+			fmt.Println("Error loading base image:", err)
+			os.Exit(1)
+		}
+
+		// Freeze the container so the layer is a consistent snapshot
+		paused := false
+		if flagCommitPause && c.Cgroup != "" && isProcessRunning(c.Pid) {
+			if err := cgroups.Freeze(c.Cgroup, true); err != nil {
+				fmt.Println("Warning: cannot pause container:", err)
+			} else {
+				paused = true
+			}
+		}
+
+		img, err := commitContainer(c, base, args[1], image.CommitOptions{
+			Author:  flagCommitAuthor,
+			Message: flagCommitMessage,
+			Changes: flagCommitChanges,
+		})
+		if paused {
+			if err := cgroups.Freeze(c.Cgroup, false); err != nil {
+				fmt.Println("Warning: cannot resume container:", err)
+			}
+		}
+		if err != nil {
+			fmt.Println("Error committing container:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Committed", img.Name, img.ID[:12])
+	},
+}
+
+// commitBase returns the image a container's changes are committed on top
+// of. Containers not started from an image are overlays of the cached rootfs,
+// which becomes their base layer; full copies have no base.
+func commitBase(c *container.Container) (*image.Image, error) {
+	if c.Image != "" {
+		return image.Get(c.Image)
+	}
+	if c.UpperDir == "" {
+		return nil, nil
+	}
+	return image.FromTrees(c.LowerDirs)
+}
+
+// commitContainer creates image ref from base plus the container's upper
+// layer, or from its whole tree when it has no base. Files are owned by the
+// ids the container sees, not those they were shifted to for --userns.
+func commitContainer(c *container.Container, base *image.Image, ref string, opts image.CommitOptions) (*image.Image, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		if c.UpperDir != "" {
+			pw.CloseWithError(rootfs.WriteShiftedLayerTar(pw, c.UpperDir, c.LowerDirs, c.ContainerIDs()))
+		} else {
+			pw.CloseWithError(rootfs.WriteShiftedTar(pw, c.RootFs, c.ContainerIDs()))
+		}
+	}()
+	defer pr.Close()
+	return image.Commit(base, pr, ref, opts)
+}
+
+func init() {
+	commitCmd.Flags().StringVarP(&flagCommitAuthor, "author", "a", "", "Author of the image")
+	commitCmd.Flags().StringVarP(&flagCommitMessage, "message", "m", "", "Commit message")
+	commitCmd.Flags().StringArrayVarP(&flagCommitChanges, "change", "c", nil, "Apply an ENV, CMD, ENTRYPOINT or WORKDIR instruction to the image config")
+	commitCmd.Flags().BoolVar(&flagCommitPause, "pause", true, "Pause the container while committing")
+
+	rootCmd.AddCommand(commitCmd)
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gocount/internal/container"
+	"gocount/internal/image"
+)
+
+func writeFiles(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// findLayer returns the layer of img holding name, topmost first
+func findLayer(img *image.Image, name string) string {
+	for _, dir := range img.LowerDirs() {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+func TestCommitWithoutImage(t *testing.T) {
+	defer func(root string) { image.Root = root }(image.Root)
+	image.Root = t.TempDir()
+
+	cached, upper := t.TempDir(), t.TempDir()
+	writeFiles(t, cached, "bin/sh", "lib/libc.so")
+	writeFiles(t, upper, "root/new")
+	c := &container.Container{ID: "test", LowerDirs: []string{cached}, UpperDir: upper}
+
+	for _, ref := range []string{"first:1", "second:1"} {
+		base, err := commitBase(c)
+		if err != nil {
+			t.Fatalf("commitBase: %v", err)
+		}
+		img, err := commitContainer(c, base, ref, image.CommitOptions{})
+		if err != nil {
+			t.Fatalf("commitContainer: %v", err)
+		}
+		if len(img.Layers) != 2 {
+			t.Fatalf("%s has layers %v, want the cached rootfs and the upper dir", ref, img.Layers)
+		}
+		for _, name := range []string{"bin/sh", "lib/libc.so", "root/new"} {
+			if findLayer(img, name) == "" {
+				t.Errorf("%s is missing %s", ref, name)
+			}
+		}
+	}
+
+	// The cached rootfs is imported once and shared by both images
+	layers, _ := os.ReadDir(filepath.Join(image.Root, "layers"))
+	if len(layers) != 2 {
+		t.Errorf("layer store holds %d layers, want 2", len(layers))
+	}
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gocount/internal/cgroups"
+	"gocount/internal/container"
+	"gocount/internal/rootfs"
+
+	"github.com/spf13/cobra"
+)
+
+var cpCmd = &cobra.Command{
+	Use:   "cp [src] [dst]",
+	Short: "Copy files between the host and a container",
+	Long: `Copy files or directories between the host and a running or stopped container.
+One side must be <container_id>:<path>. Use "-" as the host side to stream a
+tar archive through stdin or stdout.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		srcID, srcPath := splitContainerPath(args[0])
+		dstID, dstPath := splitContainerPath(args[1])
+		if (srcID == "") == (dstID == "") {
+			fmt.Println("Error: exactly one of src and dst must be <container_id>:<path>")
+			os.Exit(1)
+		}
+
+		var err error
+		if srcID != "" {
+			err = copyFromContainer(srcID, srcPath, dstPath)
+		} else {
+			err = copyToContainer(srcPath, dstID, dstPath)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// splitContainerPath splits "<id>:<path>"; host paths return an empty ID
+func splitContainerPath(arg string) (string, string) {
+	i := strings.Index(arg, ":")
+	if i <= 0 || strings.Contains(arg[:i], "/") {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// containerRoot returns the host path of a container's root filesystem
+// and a function to call when done with it. Running containers are reached
+// through /proc so their mounts are visible, and stay frozen until then:
+// otherwise a process could swap a path component we checked for a
+// symlink to the host before we use it.
+func containerRoot(id string) (string, func(), error) {
+	c, err := container.Lookup(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if c.Status == "running" && c.Pid > 0 && isProcessRunning(c.Pid) {
+		if c.Cgroup == "" {
+			return "", nil, fmt.Errorf("container %s has no cgroup to freeze during the copy, stop it first", id)
+		}
+		if err := cgroups.Freeze(c.Cgroup, true); err != nil {
+			return "", nil, fmt.Errorf("cannot freeze container: %v", err)
+		}
+		thaw := func() {
+			if err := cgroups.Freeze(c.Cgroup, false); err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: cannot resume container:", err)
+			}
+		}
+		return fmt.Sprintf("/proc/%d/root", c.Pid), thaw, nil
+	}
+	if err := c.MountRootfs(); err != nil {
+		return "", nil, err
+	}
+	return c.RootFs, func() {}, nil
+}
+
+func copyFromContainer(id, srcPath, dst string) error {
+	root, release, err := containerRoot(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Resolve the parent inside the container; the last component is copied
+	// as-is, even if it is a symlink
+	clean := filepath.Clean("/" + srcPath)
+	src := root
+	if clean != "/" {
+		parent, err := rootfs.SecureJoin(root, filepath.Dir(clean))
+		if err != nil {
+			return err
+		}
+		src = filepath.Join(parent, filepath.Base(clean))
+	}
+	if _, err := os.Lstat(src); err != nil {
+		return fmt.Errorf("%s:%s: no such file or directory", id, srcPath)
+	}
+
+	name := filepath.Base(clean)
+	if clean == "/" {
+		name = id
+	}
+	if dst == "-" {
+		return rootfs.WriteTarPath(os.Stdout, src, name)
+	}
+
+	dir, name := copyTarget(dst, name)
+	return copyTree(src, dir, name)
+}
+
+func copyToContainer(src, id, dstPath string) error {
+	root, release, err := containerRoot(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Symlinks inside the container are resolved relative to its root
+	dst, err := rootfs.SecureJoin(root, dstPath)
+	if err != nil {
+		return err
+	}
+
+	if src == "-" {
+		if fi, err := os.Stat(dst); err != nil || !fi.IsDir() {
+			return fmt.Errorf("%s:%s: not a directory", id, dstPath)
+		}
+		return rootfs.ExtractArchive(os.Stdin, dst)
+	}
+
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+	dir, name := copyTarget(dst, filepath.Base(filepath.Clean(src)))
+	return copyTree(src, dir, name)
+}
+
+// copyTarget decides where a copy lands: inside dst if it is an existing
+// directory, otherwise at dst itself
+func copyTarget(dst, srcName string) (string, string) {
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		return dst, srcName
+	}
+	return filepath.Dir(dst), filepath.Base(dst)
+}
+
+// copyTree streams src through tar into dir/name, preserving modes,
+// ownership and links
+func copyTree(src, dir, name string) error {
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("destination directory %s does not exist", dir)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rootfs.WriteTarPath(pw, src, name))
+	}()
+	err := rootfs.ExtractArchive(pr, dir)
+	pr.CloseWithError(err)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+}
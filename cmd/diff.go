@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gocount/internal/container"
+	"gocount/internal/rootfs"
+
+	"github.com/spf13/cobra"
+)
+
+var flagDiffJSON bool
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [container_id]",
+	Short: "List files added (A), changed (C) or deleted (D) in a container",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := container.Lookup(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if len(c.LowerDirs) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: container %s does not record the rootfs it was created from\n", c.ID)
+			os.Exit(1)
+		}
+		for _, dir := range c.LowerDirs {
+			if _, err := os.Stat(dir); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: base of container %s is gone (removed with cache clean --all?): %v\n", c.ID, err)
+				os.Exit(1)
+			}
+		}
+
+		// Overlay containers record their changes in the upper dir, full
+		// copies are compared against the tree they were copied from
+		var changes []rootfs.Change
+		if c.UpperDir != "" {
+			changes, err = rootfs.OverlayChanges(c.UpperDir, c.LowerDirs, c.ContainerIDs())
+		} else {
+			changes, err = rootfs.TreeChanges(c.LowerDirs, c.RootFs, c.ContainerIDs())
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+
+		if flagDiffJSON {
+			if changes == nil {
+				changes = []rootfs.Change{}
+			}
+			data, _ := json.MarshalIndent(changes, "", "  ")
+			fmt.Println(string(data))
+			return
+		}
+		for _, ch := range changes {
+			fmt.Println(ch.Kind, ch.Path)
+		}
+	},
+}
+
+func init() {
+	diffCmd.Flags().BoolVar(&flagDiffJSON, "json", false, "Print changes as JSON")
+
+	rootCmd.AddCommand(diffCmd)
+}
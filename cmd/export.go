@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gocount/internal/container"
+	"gocount/internal/image"
+	"gocount/internal/rootfs"
+
+	"github.com/spf13/cobra"
+)
+
+var flagExportOutput string
+
+var exportCmd = &cobra.Command{
+	Use:   "export [container_id]",
+	Short: "Export a container's filesystem as a tar archive",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := container.Lookup(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		// Image-based containers export the merged overlay view
+		if err := c.MountRootfs(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error mounting rootfs:", err)
+			os.Exit(1)
+		}
+
+		var out io.Writer = os.Stdout
+		if flagExportOutput != "" && flagExportOutput != "-" {
+			f, err := os.Create(flagExportOutput)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			out = f
+		}
+
+		if err := rootfs.WriteShiftedTar(out, c.RootFs, c.ContainerIDs()); err != nil {
+			fmt.Fprintln(os.Stderr, "Error exporting container:", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [file] [name:tag]",
+	Short: "Create an image from a filesystem tarball",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var in io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			in = f
+		}
+
+		img, err := image.Import(in, args[1])
+		if err != nil {
+			fmt.Println("Error importing image:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Imported", img.Name, img.ID[:12])
+	},
+}
+
+func init() {
+	exportCmd.Flags().StringVarP(&flagExportOutput, "output", "o", "", "Write to a file instead of stdout")
+
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+
+	"gocount/internal/image"
+
+	"github.com/spf13/cobra"
+)
+
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "List images",
+	Run: func(cmd *cobra.Command, args []string) {
+		images, err := image.List()
+		if err != nil {
+			fmt.Println("Error loading images:", err)
+			return
+		}
+
+		fmt.Println("IMAGE\tID\tLAYERS\tCREATED")
+		for _, img := range images {
+			fmt.Printf("%s\t%s\t%d\t%s\n", img.Name, img.ID[:12], len(img.Layers), img.Created.Format("2006-01-02 15:04:05"))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(imagesCmd)
+}
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"gocount/internal/container"
+	"gocount/internal/rootfs"
 
 	"github.com/spf13/cobra"
 )
@@ -37,6 +39,27 @@ var inspectCmd = &cobra.Command{
 		fmt.Printf("  Command:   %v\n", c.Command)
 		fmt.Printf("  RootFS:    %s\n", c.RootFs)
 		fmt.Printf("  Cgroup:    %s\n", c.Cgroup)
+		if c.Network != "" {
+			fmt.Printf("  Network:   %s\n", c.Network)
+		}
+		if c.Rootless {
+			fmt.Printf("  Rootless:  true\n")
+		}
+		if c.Hostname != "" {
+			fmt.Printf("  Hostname:  %s\n", c.Hostname)
+		}
+		if c.Domainname != "" {
+			fmt.Printf("  Domain:    %s\n", c.Domainname)
+		}
+		if c.WorkingDir != "" {
+			fmt.Printf("  Workdir:   %s\n", c.WorkingDir)
+		}
+		if len(c.Env) > 0 {
+			fmt.Printf("\nEnvironment:\n")
+			for _, kv := range c.Env {
+				fmt.Printf("  %s\n", kv)
+			}
+		}
 
 		fmt.Printf("\nProcess Status:\n")
 		if isProcessRunning(c.Pid) {
@@ -46,6 +69,11 @@ var inspectCmd = &cobra.Command{
 			if status := readProcStatus(c.Pid); status != "" {
 				fmt.Printf("  State:     %s\n", status)
 			}
+			if capEff := readProcField(c.Pid, "CapEff"); capEff != "" {
+				if names, err := container.CapabilityNames(capEff); err == nil {
+					fmt.Printf("  CapEff:    %s\n", strings.Join(names, ", "))
+				}
+			}
 		} else {
 			fmt.Printf("  Running:   No\n")
 		}
@@ -56,6 +84,84 @@ var inspectCmd = &cobra.Command{
 			showCgroupInfo(c.Cgroup)
 		}
 
+		if len(c.Mounts) > 0 || len(c.Tmpfs) > 0 {
+			fmt.Printf("\nMounts:\n")
+			for _, m := range c.Mounts {
+				mode := "rw"
+				if m.ReadOnly {
+					mode = "ro"
+				}
+				propagation := m.Propagation
+				if propagation == "" {
+					propagation = "rprivate"
+				}
+				source := m.Source
+				if m.Volume != "" {
+					source = "volume " + m.Volume
+				}
+				fmt.Printf("  %s -> %s (%s, %s)\n", source, m.Destination, mode, propagation)
+			}
+			for _, t := range c.Tmpfs {
+				fmt.Printf("  tmpfs -> %s (%s)\n", t.Destination, strings.Join(t.Options, ","))
+			}
+		}
+
+		if len(c.Devices) > 0 {
+			fmt.Printf("\nDevices:\n")
+			for _, d := range c.Devices {
+				fmt.Printf("  %s -> %s (%s %d:%d, %s)\n", d.HostPath, d.Path, d.Type, d.Major, d.Minor, d.Access)
+			}
+		}
+
+		if len(c.Ulimits) > 0 {
+			fmt.Printf("\nUlimits:\n")
+			running := isProcessRunning(c.Pid)
+			for _, u := range c.Ulimits {
+				fmt.Printf("  %s: %s", u.Name, u)
+				if running {
+					if current := readProcLimit(c.Pid, container.UlimitLabel(u.Name)); current != "" {
+						fmt.Printf(" (now %s)", current)
+					}
+				}
+				fmt.Println()
+			}
+		}
+
+		fmt.Printf("\nSecurity:\n")
+		if c.User != "" {
+			fmt.Printf("  User: %s\n", c.User)
+		}
+		fmt.Printf("  Privileged: %v\n", c.Privileged)
+		if len(c.Capabilities) > 0 {
+			fmt.Printf("  Capabilities: %s\n", strings.Join(c.Capabilities, ", "))
+		} else if c.Capabilities != nil {
+			fmt.Printf("  Capabilities: none\n")
+		}
+		fmt.Printf("  Seccomp: %s\n", seccompDescription(c))
+		fmt.Printf("  No new privileges: %v\n", c.NoNewPrivileges)
+		if c.NoSuid {
+			fmt.Printf("  Rootfs: nosuid\n")
+		}
+		if len(c.MaskedPaths) > 0 {
+			fmt.Printf("  Masked: %s\n", strings.Join(c.MaskedPaths, ", "))
+		}
+		if len(c.ReadonlyPaths) > 0 {
+			fmt.Printf("  Read-only: %s\n", strings.Join(c.ReadonlyPaths, ", "))
+		}
+		if c.UserNS() {
+			for _, m := range c.UIDMap {
+				fmt.Printf("  UID map: %d -> %d (%d ids)\n", m.ContainerID, m.HostID, m.Size)
+			}
+			for _, m := range c.GIDMap {
+				fmt.Printf("  GID map: %d -> %d (%d ids)\n", m.ContainerID, m.HostID, m.Size)
+			}
+		}
+
+		if c.StorageDir != "" {
+			fmt.Printf("\nStorage:\n")
+			showStorageInfo(c)
+		}
+
 		// Namespaces
 		fmt.Printf("\nNamespaces:\n")
 		showNamespaces(c.Pid)
@@ -63,14 +169,56 @@ var inspectCmd = &cobra.Command{
 }
 
 func readProcStatus(pid int) string {
+	return readProcField(pid, "State")
+}
+
+// seccompDescription names the container's seccomp profile
+func seccompDescription(c *container.Container) string {
+	var desc string
+	switch {
+	case c.SeccompFilter() == nil:
+		return container.Unconfined
+	case c.SeccompProfile == "":
+		desc = "default"
+	default:
+		desc = c.SeccompProfile
+	}
+	if c.SeccompLog {
+		desc += " (log only)"
+	}
+	return desc
+}
+
+// readProcLimit returns the soft:hard limit in a row of /proc/<pid>/limits,
+// such as "Max open files"
+func readProcLimit(pid int, label string) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/limits", pid))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, label+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, label))
+		if len(fields) < 2 {
+			return ""
+		}
+		return fields[0] + ":" + fields[1]
+	}
+	return ""
+}
+
+// readProcField returns a field of /proc/<pid>/status, such as CapEff
+func readProcField(pid int, field string) string {
 	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
 	if err != nil {
 		return ""
 	}
 	lines := strings.Split(string(data), "\n")
 	for _, line := range lines {
-		if strings.HasPrefix(line, "State:") {
-			return strings.TrimPrefix(line, "State:\t")
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":\t")
 		}
 	}
 	return ""
@@ -151,6 +299,22 @@ func showCgroupInfo(cgPath string) {
 	}
 }
 
+func showStorageInfo(c *container.Container) {
+	limit := strconv.FormatInt(c.StorageSize, 10)
+	fmt.Printf("  Storage Limit:   %s bytes (%s)\n", limit, formatBytes(limit))
+	if !rootfs.IsMountpoint(c.StorageDir) {
+		fmt.Printf("  Storage Usage:   not mounted\n")
+		return
+	}
+	used, total, err := rootfs.StorageUsage(c.StorageDir)
+	if err != nil {
+		fmt.Printf("  Storage Usage:   unavailable (%v)\n", err)
+		return
+	}
+	usedStr := strconv.FormatUint(used, 10)
+	fmt.Printf("  Storage Usage:   %s bytes (%s of %s usable)\n", usedStr, formatBytes(usedStr), formatBytes(strconv.FormatUint(total, 10)))
+}
+
 func showNamespaces(pid int) {
 	nsPath := fmt.Sprintf("/proc/%d/ns", pid)
 	entries, err := os.ReadDir(nsPath)
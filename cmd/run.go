@@ -1,30 +1,74 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"gocount/internal/cgroups"
+	"gocount/internal/config"
 	"gocount/internal/container"
+	"gocount/internal/image"
 	"gocount/internal/network"
+	"gocount/internal/paths"
 	"gocount/internal/rootfs"
+	"gocount/internal/seccomp"
+	"gocount/internal/volume"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
 )
 
 var (
 	flagMemory string
 	flagCPU    string
+
+	flagRootfsURL    string
+	flagRootfsSHA256 string
+	flagRootfsSig    string
+	flagRootfsPubKey string
+
+	flagImage string
+
+	flagStorageSize   string
+	flagReadOnly      bool
+	flagReadOnlyTmpfs bool
+	flagVolumes       []string
+	flagTmpfs         []string
+	flagShmSize       string
+	flagDevices       []string
+	flagPrivileged    bool
+	flagMask          []string
+	flagUnmask        []string
+	flagUserNS        bool
+	flagUIDMap        []string
+	flagGIDMap        []string
+	flagNetwork       string
+	flagCapAdd        []string
+	flagCapDrop       []string
+	flagSeccomp       string
+	flagSeccompLog    bool
+	flagNoNewPrivs    bool
+	flagNoSuid        bool
+	flagUser          string
+	flagEnv           []string
+	flagEnvFile       []string
+	flagWorkdir       string
+	flagHostname      string
+	flagDomainname    string
+	flagUlimits       []string
 )
 
 var runCmd = &cobra.Command{
 	Use:   "run [command]",
 	Short: "Run a command in a new container",
-	Args:  cobra.MinimumNArgs(1),
+	Args:  cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Check if we're the child process FIRST
 		if os.Getenv("GOCOUNT_CHILD") == "1" {
@@ -32,74 +76,274 @@ var runCmd = &cobra.Command{
 			return
 		}
 
+		var img *image.Image
+		if flagImage != "" {
+			var err error
+			if img, err = image.Get(flagImage); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			// Fall back to the image's default command
+			if len(args) == 0 {
+				args = img.Config.Command()
+			}
+		}
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "Error: no command given")
+			os.Exit(1)
+		}
+
+		var mounts []container.Mount
+		for _, spec := range flagVolumes {
+			m, err := container.ParseVolume(spec)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			mounts = append(mounts, m)
+		}
+		var tmpfs []container.Tmpfs
+		for _, spec := range flagTmpfs {
+			t, err := container.ParseTmpfs(spec)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			tmpfs = append(tmpfs, t)
+		}
+		var devices []container.Device
+		for _, spec := range flagDevices {
+			d, err := container.ParseDevice(spec)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			devices = append(devices, d)
+		}
+		uidMap, gidMap, err := userNSMaps()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		caps, err := container.Capabilities(flagCapAdd, flagCapDrop)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		if flagPrivileged {
+			caps = container.AllCapabilities()
+		}
+		var seccompRules *seccomp.Profile
+		if flagSeccomp != "" && flagSeccomp != container.Unconfined {
+			if seccompRules, err = seccomp.Load(flagSeccomp); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+		}
+		var env []string
+		for _, file := range flagEnvFile {
+			fileEnv, err := container.ReadEnvFile(file)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			env = append(env, fileEnv...)
+		}
+		vars, err := container.ParseEnv(flagEnv)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		env = append(env, vars...)
+		if flagWorkdir != "" && !filepath.IsAbs(flagWorkdir) {
+			fmt.Fprintf(os.Stderr, "Error: working directory %q is not absolute\n", flagWorkdir)
+			os.Exit(1)
+		}
+		if len(flagHostname) > 64 || len(flagDomainname) > 64 {
+			fmt.Fprintln(os.Stderr, "Error: hostname and domain name are limited to 64 characters")
+			os.Exit(1)
+		}
+		ulimits, err := defaultUlimits()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		for _, spec := range flagUlimits {
+			u, err := container.ParseUlimits(spec)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			ulimits = container.MergeUlimits(ulimits, u)
+		}
+		if flagNetwork != "" && !network.ValidMode(flagNetwork) {
+			fmt.Fprintf(os.Stderr, "Error: unknown network mode %q\n", flagNetwork)
+			os.Exit(1)
+		}
+		if paths.Rootless() {
+			if flagNetwork == network.Bridge {
+				fmt.Fprintln(os.Stderr, "Error: bridge networking needs root, use --network slirp4netns or none")
+				os.Exit(1)
+			}
+			if flagStorageSize != "" {
+				fmt.Fprintln(os.Stderr, "Error: --storage-size needs root to attach a loop device")
+				os.Exit(1)
+			}
+		}
+		var shmSize int64
+		if flagShmSize != "" {
+			var err error
+			if shmSize, err = rootfs.ParseSize(flagShmSize); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --shm-size: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
 		// Parent process - generate ID and setup
 		id := container.GenerateID()
 		fmt.Println("Starting container:", id, "command:", args)
-		rootdir := "/tmp/gocount/" + id + "/rootfs"
+		rootdir := filepath.Join(paths.Root, id, "rootfs")
+
+		// Register in memory
+		c := &container.Container{
+			ID:            id,
+			Command:       args,
+			RootFs:        rootdir,
+			ReadOnly:      flagReadOnly,
+			ReadOnlyTmpfs: flagReadOnly && flagReadOnlyTmpfs,
+		}
+		c.Mounts = mounts
+		c.Tmpfs = tmpfs
+		c.ShmSize = shmSize
+		c.Devices = devices
+		c.UIDMap = uidMap
+		c.GIDMap = gidMap
+		c.Rootless = paths.Rootless()
+		c.Network = network.DefaultMode(c.Rootless)
+		if flagNetwork != "" {
+			c.Network = flagNetwork
+		}
+		c.Capabilities = caps
+		c.Privileged = flagPrivileged
+		c.SeccompProfile = flagSeccomp
+		c.SeccompRules = seccompRules
+		c.SeccompLog = flagSeccompLog
+		// Privileged containers may use setuid binaries unless asked not to
+		c.NoNewPrivileges = flagNoNewPrivs
+		if flagPrivileged && !cmd.Flags().Changed("no-new-privileges") {
+			c.NoNewPrivileges = false
+		}
+		c.NoSuid = flagNoSuid
+		c.User = flagUser
+		c.Hostname = id
+		if flagHostname != "" {
+			c.Hostname = flagHostname
+		}
+		c.Domainname = flagDomainname
+		c.WorkingDir = flagWorkdir
+		var imageEnv []string
+		if img != nil {
+			imageEnv = img.Config.Env
+			if c.WorkingDir == "" {
+				c.WorkingDir = img.Config.WorkingDir
+			}
+		}
+		c.Env = container.MergeEnv(container.DefaultEnv(c.Hostname), imageEnv, env)
+		c.Ulimits = ulimits
+		if !flagPrivileged {
+			c.MaskedPaths, c.ReadonlyPaths = container.SecurityPaths(flagMask, flagUnmask)
+		}
 
-		// Ensure rootfs exists before starting container
-		if err := rootfs.EnsureRootfs(rootdir); err != nil {
-			fmt.Fprintf(os.Stderr, "Error setting up rootfs: %v\n", err)
+		// The writable layer goes on a size-limited filesystem if requested
+		layerDir := filepath.Join(paths.Root, id)
+		if flagStorageSize != "" {
+			size, err := rootfs.ParseSize(flagStorageSize)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --storage-size: %v\n", err)
+				os.Exit(1)
+			}
+			c.StorageSize = size
+			c.StorageDir = layerDir + "/storage"
+			layerDir = c.StorageDir
+		}
+		c.UpperDir = layerDir + "/upper"
+		c.WorkDir = layerDir + "/work"
+
+		if img != nil {
+			// Image-based container: overlay the image layers with a private upper dir
+			c.Image = img.Name
+			c.LowerDirs = img.LowerDirs()
+			if err := c.PrepareRootfs(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error setting up rootfs: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			// Share one verified, extracted copy of the rootfs between containers
+			src := rootfs.SourceFor(flagRootfsURL)
+			if flagRootfsSHA256 != "" {
+				src.SHA256 = flagRootfsSHA256
+			}
+			src.SignatureURL = flagRootfsSig
+			src.PublicKey = flagRootfsPubKey
+			tree, err := rootfs.CachedRootfs(src)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error setting up rootfs: %v\n", err)
+				os.Exit(1)
+			}
+			if err := setupCachedRootfs(c, tree); err != nil {
+				fmt.Fprintf(os.Stderr, "Error setting up rootfs: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		// A rootless container's files already belong to its root
+		if c.UserNS() && !c.Rootless {
+			if err := c.ChownRootfs(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error setting up rootfs for user namespace: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if err := setupVolumes(c); err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting up volumes: %v\n", err)
 			os.Exit(1)
 		}
 
 		// Create cgroup before starting the child so we can configure limits
 		cgPath, err := cgroups.Create(id)
-		if err != nil {
+		if err != nil && !c.Rootless {
 			fmt.Println("Error creating cgroup:", err)
 			os.Exit(1)
 		}
-
-		// Set limits if provided (ignore errors but print)
-		if err := cgroups.SetMemoryLimit(cgPath, flagMemory); err != nil {
-			fmt.Println("Warning: cannot set memory limit:", err)
-		}
-		if err := cgroups.SetCPUQuota(cgPath, flagCPU); err != nil {
-			fmt.Println("Warning: cannot set cpu quota:", err)
+		if err != nil {
+			fmt.Println("Warning: no cgroup, running without resource limits:", err)
+		} else {
+			setLimits(c, cgPath)
 		}
+		c.Cgroup = cgPath
 
-		command := exec.Command("/proc/self/exe", append([]string{"run"}, args...)...)
-		command.Stdin = os.Stdin
-		command.Stdout = os.Stdout
-		command.Stderr = os.Stderr
-		command.Env = append(os.Environ(),
-			"GOCOUNT_CHILD=1",
-			"GOCOUNT_CONTAINER_ID="+id,
-			"GOCOUNT_ROOTFS="+rootdir,
-		)
-
-		command.SysProcAttr = &syscall.SysProcAttr{
-			Cloneflags: syscall.CLONE_NEWUTS |
-				syscall.CLONE_NEWPID |
-				syscall.CLONE_NEWNS |
-				syscall.CLONE_NEWNET,
-		}
+		command := newChildCommand(c)
 
 		if err := container.EnsureContainerDir(); err != nil {
 			fmt.Println("Error creating container dir:", err)
 			os.Exit(1)
 		}
 
-		if err := command.Start(); err != nil {
+		if err := startChild(c, command); err != nil {
 			fmt.Println("Error:", err)
 			os.Exit(1)
 		}
 
-		// NOW setup the veth pair from the parent side
+		// NOW setup the network from the parent side
 		// The child process exists and has its network namespace
-		if err := network.SetupVethPair(id, command.Process.Pid); err != nil {
+		stopNetwork, err := network.Setup(c.Network, id, command.Process.Pid)
+		if err != nil {
 			fmt.Println("Warning: network setup failed:", err)
 		}
+		defer stopNetwork()
 
-		// Register in memory
-		c := &container.Container{
-			ID:      id,
-			Pid:     command.Process.Pid,
-			Command: args,
-			Status:  "running",
-			RootFs:  rootdir,
-			Cgroup:  cgPath,
-		}
+		c.Pid = command.Process.Pid
+		c.Status = "running"
 		container.Containers[id] = c
 
 		// Save to disk
@@ -138,25 +382,15 @@ var startCmd = &cobra.Command{
 
 		fmt.Println("Starting container:", id, "command:", c.Command)
 
+		if err := c.PrepareRootfs(); err != nil {
+			fmt.Println("Error mounting rootfs:", err)
+			os.Exit(1)
+		}
+
 		// Fork a new process to run the container
-		command := exec.Command("/proc/self/exe", append([]string{"run"}, c.Command...)...)
-		command.Stdin = os.Stdin
-		command.Stdout = os.Stdout
-		command.Stderr = os.Stderr
-		command.Env = append(os.Environ(),
-			"GOCOUNT_CHILD=1",
-			"GOCOUNT_CONTAINER_ID="+id,
-			"GOCOUNT_ROOTFS="+c.RootFs,
-		)
-
-		command.SysProcAttr = &syscall.SysProcAttr{
-			Cloneflags: syscall.CLONE_NEWUTS |
-				syscall.CLONE_NEWPID |
-				syscall.CLONE_NEWNS |
-				syscall.CLONE_NEWNET,
-		}
-
-		if err := command.Start(); err != nil {
+		command := newChildCommand(c)
+
+		if err := startChild(c, command); err != nil {
 			fmt.Println("Error:", err)
 			os.Exit(1)
 		}
@@ -164,10 +398,11 @@ var startCmd = &cobra.Command{
 		// Update container info
 		c.Pid = command.Process.Pid
 		c.Status = "running"
-		err := network.SetupVethPair(id, c.Pid)
+		stopNetwork, err := network.Setup(c.Network, id, c.Pid)
 		if err != nil {
-			fmt.Println("Error setting up veth:", err)
+			fmt.Println("Error setting up network:", err)
 		}
+		defer stopNetwork()
 
 		// Save updated status
 		if err := container.SaveContainer(c); err != nil {
@@ -180,6 +415,242 @@ var startCmd = &cobra.Command{
 	},
 }
 
+// setupCachedRootfs gives c a private root on top of a cached rootfs tree:
+// an overlay with the tree as lower dir, or a reflinked copy where overlayfs
+// is unavailable. The tree stays in LowerDirs either way, so diff works.
+func setupCachedRootfs(c *container.Container, tree string) error {
+	c.LowerDirs = []string{tree}
+	err := c.PrepareRootfs()
+	if err == nil {
+		return nil
+	}
+	if c.StorageDir != "" && !rootfs.IsMountpoint(c.StorageDir) {
+		return err
+	}
+	fmt.Println("Warning: overlay unavailable, copying rootfs:", err)
+
+	for _, d := range []string{c.RootFs, c.UpperDir, c.WorkDir} {
+		if err := os.RemoveAll(d); err != nil {
+			return err
+		}
+	}
+	// LowerDirs stays set: diff compares the copy against the tree
+	c.UpperDir, c.WorkDir = "", ""
+	if c.StorageDir != "" {
+		// The copy is the writable layer, so it goes on the storage mount
+		c.RootFs = filepath.Join(c.StorageDir, "rootfs")
+	}
+	return rootfs.CloneTree(tree, c.RootFs)
+}
+
+// setupVolumes resolves the named volumes of c, creating missing ones. An
+// empty volume is seeded with whatever the image has at its destination.
+func setupVolumes(c *container.Container) error {
+	for i := range c.Mounts {
+		m := &c.Mounts[i]
+		if m.Volume == "" {
+			continue
+		}
+		v, err := volume.Ensure(m.Volume)
+		if err != nil {
+			return err
+		}
+		m.Source = v.Mountpoint()
+		if !v.IsEmpty() {
+			continue
+		}
+		if c.Rootless {
+			// The rootfs is only mounted inside the container
+			fmt.Printf("Warning: volume %s starts empty, rootless containers cannot copy image content into it\n", m.Volume)
+			continue
+		}
+
+		src, err := rootfs.SecureJoin(c.RootFs, m.Destination)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := os.Remove(m.Source); err != nil {
+			return err
+		}
+		if err := rootfs.CloneTree(src, m.Source); err != nil {
+			return fmt.Errorf("failed to copy %s into volume %s: %v", m.Destination, m.Volume, err)
+		}
+	}
+	return nil
+}
+
+// newChildCommand prepares the re-exec of gocount that sets up the
+// container's namespaces and mounts and then execs c.Command
+func newChildCommand(c *container.Container) *exec.Cmd {
+	// "--" keeps the container command's own flags away from cobra
+	command := exec.Command("/proc/self/exe", append([]string{"run", "--"}, c.Command...)...)
+	command.Stdin = os.Stdin
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	command.Env = append(os.Environ(),
+		"GOCOUNT_CHILD=1",
+		"GOCOUNT_CONTAINER_ID="+c.ID,
+		"GOCOUNT_ROOTFS="+c.RootFs,
+	)
+	opts, _ := json.Marshal(c.MountOptions())
+	command.Env = append(command.Env, "GOCOUNT_MOUNT_OPTIONS="+string(opts))
+	command.Env = append(command.Env, "GOCOUNT_NETWORK="+c.Network)
+	if c.Capabilities != nil {
+		command.Env = append(command.Env, "GOCOUNT_CAPABILITIES="+strings.Join(c.Capabilities, ","))
+	}
+	if c.User != "" {
+		command.Env = append(command.Env, "GOCOUNT_USER="+c.User)
+	}
+	if c.NoNewPrivileges {
+		command.Env = append(command.Env, "GOCOUNT_NO_NEW_PRIVS=1")
+	}
+	if p := c.SeccompFilter(); p != nil {
+		profile, _ := json.Marshal(p)
+		command.Env = append(command.Env, "GOCOUNT_SECCOMP="+string(profile))
+	}
+	hostname := c.Hostname
+	if hostname == "" {
+		hostname = c.ID
+	}
+	env := c.Env
+	if env == nil {
+		env = container.DefaultEnv(hostname)
+	}
+	// The command's environment is kept apart from ours, which has the
+	// host's variables and the settings above
+	data, _ := json.Marshal(env)
+	command.Env = append(command.Env, "GOCOUNT_ENV="+string(data))
+	command.Env = append(command.Env, "GOCOUNT_HOSTNAME="+hostname)
+	if c.Domainname != "" {
+		command.Env = append(command.Env, "GOCOUNT_DOMAINNAME="+c.Domainname)
+	}
+	if c.WorkingDir != "" {
+		command.Env = append(command.Env, "GOCOUNT_WORKDIR="+c.WorkingDir)
+	}
+	if len(c.Ulimits) > 0 {
+		ulimits, _ := json.Marshal(c.Ulimits)
+		command.Env = append(command.Env, "GOCOUNT_ULIMITS="+string(ulimits))
+	}
+
+	command.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUTS |
+			syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWNET,
+	}
+	if c.UserNS() {
+		c.SetUserNS(command.SysProcAttr)
+	}
+	return command
+}
+
+// defaultUlimits returns the ulimits from the config file, lowered to our
+// own hard limits so defaults never fail on a stricter host
+func defaultUlimits() ([]container.Ulimit, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	var ulimits []container.Ulimit
+	for _, spec := range cfg.Ulimits {
+		u, err := container.ParseUlimits(spec)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %v", paths.ConfigFile, err)
+		}
+		ulimits = container.MergeUlimits(ulimits, u)
+	}
+	return container.WithinCurrent(ulimits), nil
+}
+
+// setLimits applies the resource limits of run's flags to the cgroup
+func setLimits(c *container.Container, cgPath string) {
+	// Set limits if provided (ignore errors but print)
+	if err := cgroups.SetMemoryLimit(cgPath, flagMemory); err != nil {
+		fmt.Println("Warning: cannot set memory limit:", err)
+	}
+	if err := cgroups.SetCPUQuota(cgPath, flagCPU); err != nil {
+		fmt.Println("Warning: cannot set cpu quota:", err)
+	}
+	if err := cgroups.SetDevices(cgPath, c.DeviceRules()); err != nil {
+		fmt.Println("Warning: cannot restrict devices:", err)
+	}
+}
+
+// startChild starts command, the child of c. In a user namespace the child
+// cannot move itself into its cgroup, so it is started there instead.
+func startChild(c *container.Container, command *exec.Cmd) error {
+	if !c.UserNS() || c.Cgroup == "" {
+		return command.Start()
+	}
+
+	cg, err := os.Open(c.Cgroup)
+	if err != nil {
+		return fmt.Errorf("cannot open cgroup: %v", err)
+	}
+	defer cg.Close()
+	command.SysProcAttr.UseCgroupFD = true
+	command.SysProcAttr.CgroupFD = int(cg.Fd())
+	return command.Start()
+}
+
+// userNSMaps returns the id maps requested by --userns, --uidmap and
+// --gidmap. With only one of the maps given it is used for both, and with
+// neither container root maps to the user's range in /etc/subuid and
+// /etc/subgid. Rootless containers always get a user namespace.
+func userNSMaps() ([]container.IDMap, []container.IDMap, error) {
+	if paths.Rootless() {
+		if len(flagUIDMap) > 0 || len(flagGIDMap) > 0 {
+			return nil, nil, fmt.Errorf("--uidmap and --gidmap need root, rootless containers map root to your own user")
+		}
+		uidMap, gidMap := container.RootlessIDMaps()
+		return uidMap, gidMap, nil
+	}
+
+	parse := func(specs []string) ([]container.IDMap, error) {
+		var maps []container.IDMap
+		for _, spec := range specs {
+			m, err := container.ParseIDMap(spec)
+			if err != nil {
+				return nil, err
+			}
+			maps = append(maps, m)
+		}
+		return maps, nil
+	}
+	uidMap, err := parse(flagUIDMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	gidMap, err := parse(flagGIDMap)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case uidMap == nil && gidMap == nil:
+		if !flagUserNS {
+			return nil, nil, nil
+		}
+		uid, err := container.SubIDMap("/etc/subuid")
+		if err != nil {
+			return nil, nil, err
+		}
+		gid, err := container.SubIDMap("/etc/subgid")
+		if err != nil {
+			return nil, nil, err
+		}
+		return []container.IDMap{uid}, []container.IDMap{gid}, nil
+	case uidMap == nil:
+		uidMap = gidMap
+	case gidMap == nil:
+		gidMap = uidMap
+	}
+	return uidMap, gidMap, nil
+}
+
 func childSetup(args []string) {
 	// Get rootfs path from environment (set by parent)
 	rootfsPath := os.Getenv("GOCOUNT_ROOTFS")
@@ -188,8 +659,21 @@ func childSetup(args []string) {
 		os.Exit(1)
 	}
 
+	// Namespaces from unshare belong to this thread, which must also do
+	// the mounts and the final exec
+	runtime.LockOSThread()
+
+	var opts container.MountOptions
+	if data := os.Getenv("GOCOUNT_MOUNT_OPTIONS"); data != "" {
+		if err := json.Unmarshal([]byte(data), &opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid GOCOUNT_MOUNT_OPTIONS: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// In a user namespace the parent already started us in the cgroup
 	containerID := os.Getenv("GOCOUNT_CONTAINER_ID")
-	if containerID != "" {
+	if containerID != "" && !opts.UserNS {
 		cgPath := filepath.Join("/sys/fs/cgroup", "gocount", containerID)
 		pid := os.Getpid()
 		if err := cgroups.AddProc(cgPath, pid); err != nil {
@@ -197,17 +681,143 @@ func childSetup(args []string) {
 		}
 	}
 
+	// A new cgroup namespace makes the container's cgroup its root
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot create cgroup namespace: %v\n", err)
+	}
+
 	// Setup mounts (includes pivot_root)
-	if err := container.SetupMount(rootfsPath); err != nil {
+	if err := container.SetupMount(rootfsPath, opts); err != nil {
 		fmt.Fprintf(os.Stderr, "Mount setup failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Set hostname
-	if err := syscall.Sethostname([]byte("gocount")); err != nil {
+	if err := syscall.Sethostname([]byte(os.Getenv("GOCOUNT_HOSTNAME"))); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to set hostname: %v\n", err)
 	}
+	if domainname := os.Getenv("GOCOUNT_DOMAINNAME"); domainname != "" {
+		if err := unix.Setdomainname([]byte(domainname)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set domain name: %v\n", err)
+		}
+	}
+
+	var env []string
+	if err := json.Unmarshal([]byte(os.Getenv("GOCOUNT_ENV")), &env); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid GOCOUNT_ENV: %v\n", err)
+		os.Exit(1)
+	}
 
+	// Working directory from --workdir or the image config
+	if workdir := os.Getenv("GOCOUNT_WORKDIR"); workdir != "" {
+		if err := os.MkdirAll(workdir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create workdir: %v\n", err)
+		}
+		if err := os.Chdir(workdir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to change to workdir: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	switch os.Getenv("GOCOUNT_NETWORK") {
+	case network.Slirp, network.None:
+		// slirp4netns configures tap0 from outside, loopback is up to us
+		if err := network.SetupLoopback(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	default:
+		setupBridgeNetwork()
+	}
+
+	caps := container.AllCapabilities()
+	names, dropCaps := os.LookupEnv("GOCOUNT_CAPABILITIES")
+	if dropCaps {
+		caps = nil
+		if names != "" {
+			caps = strings.Split(names, ",")
+		}
+	}
+
+	// Raising hard limits needs CAP_SYS_RESOURCE, which may be dropped below
+	if data := os.Getenv("GOCOUNT_ULIMITS"); data != "" {
+		var ulimits []container.Ulimit
+		if err := json.Unmarshal([]byte(data), &ulimits); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid GOCOUNT_ULIMITS: %v\n", err)
+			os.Exit(1)
+		}
+		if err := container.ApplyUlimits(ulimits); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set ulimits: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var profile *seccomp.Profile
+	if data := os.Getenv("GOCOUNT_SECCOMP"); data != "" {
+		profile = &seccomp.Profile{}
+		if err := json.Unmarshal([]byte(data), profile); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid GOCOUNT_SECCOMP: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// With no_new_privs the filter can go in after dropping capabilities,
+	// so it need not allow what dropping them takes. Without it,
+	// installing the filter needs CAP_SYS_ADMIN.
+	noNewPrivs := os.Getenv("GOCOUNT_NO_NEW_PRIVS") == "1"
+	if noNewPrivs {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set no_new_privs: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if profile != nil && !noNewPrivs {
+		installSeccomp(profile, caps)
+	}
+
+	// The user is looked up in the container's own /etc. HOME and USER
+	// follow it unless the environment sets them.
+	home := []string{"HOME=/root"}
+	if spec := os.Getenv("GOCOUNT_USER"); spec != "" {
+		u, err := container.LookupUser(spec)
+		if err == nil {
+			err = container.SetUser(u)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to switch to user %s: %v\n", spec, err)
+			os.Exit(1)
+		}
+		home = []string{"HOME=" + u.Home, "USER=" + u.Name}
+	}
+	env = container.MergeEnv(home, env)
+
+	// Drop capabilities, everything above needs them
+	if dropCaps {
+		if err := container.ApplyCapabilities(caps); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set capabilities: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if profile != nil && noNewPrivs {
+		installSeccomp(profile, caps)
+	}
+
+	// Execute the target command
+	if err := syscall.Exec(args[0], args, env); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to exec: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// installSeccomp applies the container's seccomp profile or exits
+func installSeccomp(profile *seccomp.Profile, caps []string) {
+	if err := profile.Install(caps); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up seccomp: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// setupBridgeNetwork configures eth0 once the parent has moved our end of
+// the veth pair into the container
+func setupBridgeNetwork() {
 	// Wait for parent to setup veth pair with retry logic
 	fmt.Println("DEBUG: Waiting for network interface...")
 	maxRetries := 50 // 5 seconds total
@@ -238,20 +848,49 @@ func childSetup(args []string) {
 	} else {
 		fmt.Println("DEBUG: Network connectivity OK")
 	}
-
-	// Execute the target command
-	if err := syscall.Exec(args[0], args, os.Environ()); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to exec: %v\n", err)
-		os.Exit(1)
-	}
 }
 
 func init() {
 	rootCmd.AddCommand(runCmd)
 
+	// Flags after the command belong to the command, not to run
+	runCmd.Flags().SetInterspersed(false)
+
 	// Add flags
 	runCmd.Flags().StringVar(&flagMemory, "memory", "", "Memory limit for container (e.g. 100M)")
 	runCmd.Flags().StringVar(&flagCPU, "cpu", "", "CPU quota for container (cgroup v2 format: 'max' or '<quota> <period>')")
+	runCmd.Flags().StringVar(&flagStorageSize, "storage-size", "", "Limit the container's writable layer (e.g. 2G)")
+	runCmd.Flags().BoolVar(&flagReadOnly, "read-only", false, "Mount the container's root filesystem read-only")
+	runCmd.Flags().BoolVar(&flagReadOnlyTmpfs, "read-only-tmpfs", true, "With --read-only, mount writable tmpfs on /tmp and /run")
+	runCmd.Flags().StringArrayVarP(&flagVolumes, "volume", "v", nil, "Bind mount a host path: host:container[:ro][,rslave|rshared|...] (repeatable)")
+	runCmd.Flags().StringArrayVar(&flagTmpfs, "tmpfs", nil, "Mount a tmpfs: /path[:size=64m,mode=1777,noexec,...] (repeatable)")
+	runCmd.Flags().StringVar(&flagShmSize, "shm-size", "", "Size of /dev/shm (default 64M)")
+	runCmd.Flags().StringArrayVar(&flagDevices, "device", nil, "Add a host device: /dev/host[:/dev/container][:rwm] (repeatable)")
+	runCmd.Flags().BoolVar(&flagPrivileged, "privileged", false, "Keep all capabilities and disable seccomp and masked and read-only kernel paths")
+	runCmd.Flags().StringArrayVar(&flagMask, "mask", nil, "Hide an extra path inside the container (repeatable)")
+	runCmd.Flags().StringArrayVar(&flagUnmask, "unmask", nil, "Expose a default masked or read-only path, or ALL (repeatable)")
+	runCmd.Flags().BoolVar(&flagUserNS, "userns", false, "Run in a user namespace, mapping root to the range in /etc/subuid and /etc/subgid")
+	runCmd.Flags().StringArrayVar(&flagUIDMap, "uidmap", nil, "User namespace uid map container:host:size (repeatable, implies --userns)")
+	runCmd.Flags().StringArrayVar(&flagGIDMap, "gidmap", nil, "User namespace gid map container:host:size (repeatable, implies --userns)")
+	runCmd.Flags().StringVar(&flagNetwork, "network", "", "Network mode: bridge, slirp4netns or none (default bridge, or slirp4netns when rootless)")
+	runCmd.Flags().StringArrayVar(&flagCapAdd, "cap-add", nil, "Add a Linux capability, or ALL (repeatable)")
+	runCmd.Flags().StringArrayVar(&flagCapDrop, "cap-drop", nil, "Drop a Linux capability, or ALL (repeatable)")
+	runCmd.Flags().StringVar(&flagSeccomp, "seccomp-profile", "", "Seccomp profile file in Docker/OCI format, or unconfined (default built-in profile)")
+	runCmd.Flags().BoolVar(&flagSeccompLog, "seccomp-log", false, "Log syscalls the seccomp profile would block instead of blocking them")
+	runCmd.Flags().BoolVar(&flagNoNewPrivs, "no-new-privileges", true, "Stop setuid binaries and file capabilities from raising privileges (default off with --privileged)")
+	runCmd.Flags().BoolVar(&flagNoSuid, "nosuid", false, "Mount the container's root filesystem nosuid")
+	runCmd.Flags().StringVarP(&flagUser, "user", "u", "", "Run the command as user[:group], by name or id from the container's /etc/passwd and /etc/group")
+	runCmd.Flags().StringArrayVarP(&flagEnv, "env", "e", nil, "Set an environment variable KEY=VALUE, or pass KEY from this environment (repeatable)")
+	runCmd.Flags().StringArrayVar(&flagEnvFile, "env-file", nil, "Read environment variables from a file of KEY=VALUE lines (repeatable)")
+	runCmd.Flags().StringVarP(&flagWorkdir, "workdir", "w", "", "Working directory of the command (default from the image, or /)")
+	runCmd.Flags().StringVar(&flagHostname, "hostname", "", "Container hostname (default the container ID)")
+	runCmd.Flags().StringVar(&flagDomainname, "domainname", "", "Container NIS domain name")
+	runCmd.Flags().StringArrayVar(&flagUlimits, "ulimit", nil, "Set resource limits name=soft[:hard],... such as nofile=1024:4096,core=0 (repeatable)")
+	runCmd.Flags().StringVar(&flagImage, "image", "", "Run from an imported image (name:tag) instead of a rootfs tarball")
+	runCmd.Flags().StringVar(&flagRootfsURL, "rootfs-url", rootfs.DefaultRootfsURL, "URL or path of the rootfs tarball (gzip, zstd, xz, bzip2 or plain tar)")
+	runCmd.Flags().StringVar(&flagRootfsSHA256, "rootfs-sha256", "", "Expected SHA-256 of the rootfs tarball (required for unknown URLs)")
+	runCmd.Flags().StringVar(&flagRootfsSig, "rootfs-sig", "", "Location of a minisign signature for the rootfs tarball (default <url>.minisig)")
+	runCmd.Flags().StringVar(&flagRootfsPubKey, "rootfs-pubkey", "", "Minisign public key (or key file) used to verify the rootfs signature")
 
 	rootCmd.AddCommand(startCmd)
 }
@@ -3,9 +3,12 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"syscall"
 
+	"gocount/internal/cgroups"
 	"gocount/internal/container"
+	"gocount/internal/paths"
 
 	"github.com/spf13/cobra"
 )
@@ -72,7 +75,20 @@ var removeCmd = &cobra.Command{
 				fmt.Printf("Container process %d killed\n", c.Pid)
 			}
 		}
-		path := fmt.Sprintf("/tmp/gocount/%s.json", c.ID)
+		if err := c.UnmountRootfs(); err != nil {
+			// Removing the directory would reach through what is still mounted
+			fmt.Printf("Error: failed to unmount rootfs, keeping %s: %v\n", filepath.Join(paths.Root, c.ID), err)
+			return
+		}
+		if err := os.RemoveAll(filepath.Join(paths.Root, c.ID)); err != nil {
+			fmt.Printf("Warning: failed to remove container files: %v\n", err)
+		}
+		if c.Cgroup != "" {
+			if err := cgroups.Delete(c.ID); err != nil {
+				fmt.Printf("Warning: failed to remove cgroup: %v\n", err)
+			}
+		}
+		path := filepath.Join(paths.Root, c.ID+".json")
 		if err := os.Remove(path); err != nil {
 			fmt.Printf("Warning: failed to remove metadata file: %v\n", err)
 		}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gocount/internal/container"
+	"gocount/internal/volume"
+
+	"github.com/spf13/cobra"
+)
+
+var volumeCmd = &cobra.Command{
+	Use:   "volume",
+	Short: "Manage named volumes",
+}
+
+var volumeCreateCmd = &cobra.Command{
+	Use:   "create [name]",
+	Short: "Create a volume",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		v, err := volume.Create(args[0])
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		fmt.Println(v.Name)
+	},
+}
+
+var volumeLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List volumes",
+	Run: func(cmd *cobra.Command, args []string) {
+		volumes, err := volume.List()
+		if err != nil {
+			fmt.Println("Error loading volumes:", err)
+			return
+		}
+
+		fmt.Println("VOLUME\tCONTAINERS\tCREATED")
+		for _, v := range volumes {
+			fmt.Printf("%s\t%d\t%s\n", v.Name, len(volumeUsers(v.Name)), v.Created.Format("2006-01-02 15:04:05"))
+		}
+	},
+}
+
+var volumeInspectCmd = &cobra.Command{
+	Use:   "inspect [name]",
+	Short: "Show details of a volume",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		v, err := volume.Get(args[0])
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+
+		users := volumeUsers(v.Name)
+		if users == nil {
+			users = []string{}
+		}
+		data, _ := json.MarshalIndent(struct {
+			*volume.Volume
+			Mountpoint string
+			Containers []string
+		}{v, v.Mountpoint(), users}, "", "  ")
+		fmt.Println(string(data))
+	},
+}
+
+var volumeRmCmd = &cobra.Command{
+	Use:   "rm [name...]",
+	Short: "Remove volumes not used by any container",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		failed := false
+		for _, name := range args {
+			if users := volumeUsers(name); len(users) > 0 {
+				fmt.Printf("Error: volume %s is in use by %v\n", name, users)
+				failed = true
+				continue
+			}
+			if err := volume.Remove(name); err != nil {
+				fmt.Println("Error:", err)
+				failed = true
+				continue
+			}
+			fmt.Println(name)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// volumeUsers returns the IDs of containers that mount the named volume.
+// Containers hold a reference until they are removed.
+func volumeUsers(name string) []string {
+	containers, _ := container.LoadContainers()
+	var ids []string
+	for _, c := range containers {
+		for _, m := range c.Mounts {
+			if m.Volume == name {
+				ids = append(ids, c.ID)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+func init() {
+	volumeCmd.AddCommand(volumeCreateCmd)
+	volumeCmd.AddCommand(volumeLsCmd)
+	volumeCmd.AddCommand(volumeInspectCmd)
+	volumeCmd.AddCommand(volumeRmCmd)
+	rootCmd.AddCommand(volumeCmd)
+}
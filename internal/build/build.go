@@ -0,0 +1,257 @@
+package build
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gocount/internal/image"
+	"gocount/internal/rootfs"
+)
+
+// RunFunc runs cmd in a container whose root is an overlay of lowerDirs
+// (topmost first) and returns the overlay upper directory. cleanup removes
+// the container once the layer has been captured.
+type RunFunc func(lowerDirs []string, config image.Config, cmd []string) (upperDir string, cleanup func(), err error)
+
+// Builder turns Gocountfile instructions into an image
+type Builder struct {
+	ContextDir string
+	Run        RunFunc
+	NoCache    bool
+	Out        io.Writer
+}
+
+// state is the image being built, one instruction at a time
+type state struct {
+	parent string
+	layers []string
+	config image.Config
+	// Cache key covering every instruction and input so far
+	key string
+}
+
+// Build executes instructions and saves the result as image ref
+func (b *Builder) Build(instructions []Instruction, ref string) (*image.Image, error) {
+	ref, err := image.ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var st state
+	for i, inst := range instructions {
+		fmt.Fprintf(b.Out, "Step %d/%d : %s\n", i+1, len(instructions), inst)
+		if err := b.step(&st, inst); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", inst.Line, inst.Keyword, err)
+		}
+	}
+
+	img := &image.Image{
+		Name:    ref,
+		Parent:  st.parent,
+		Layers:  st.layers,
+		Created: time.Now(),
+		Comment: "built from Gocountfile",
+		Config:  st.config,
+	}
+	if err := image.Save(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (b *Builder) step(st *state, inst Instruction) error {
+	switch inst.Keyword {
+	case "FROM":
+		if st.key != "" {
+			return fmt.Errorf("only one FROM is supported")
+		}
+		if inst.Args == "scratch" {
+			st.key = cacheKey("", inst.String())
+			return nil
+		}
+		base, err := image.Get(inst.Args)
+		if err != nil {
+			return err
+		}
+		st.parent = base.ID
+		st.layers = append([]string{}, base.Layers...)
+		st.config = base.Config
+		st.config.Env = append([]string{}, base.Config.Env...)
+		st.key = cacheKey("", base.ID)
+		return nil
+
+	case "ENV", "WORKDIR", "CMD", "ENTRYPOINT":
+		st.key = cacheKey(st.key, inst.String())
+		return st.config.ApplyChange(inst.String())
+
+	case "RUN":
+		if len(st.layers) == 0 {
+			return fmt.Errorf("RUN needs a base image")
+		}
+		cmd, err := image.ParseCommand(inst.Args)
+		if err != nil {
+			return err
+		}
+		st.key = cacheKey(st.key, inst.String())
+		return b.addLayer(st, func() (string, error) {
+			lower := (&image.Image{Layers: st.layers}).LowerDirs()
+			upper, cleanup, err := b.Run(lower, st.config, cmd)
+			if err != nil {
+				return "", err
+			}
+			defer cleanup()
+			return addLayerFrom(func(w io.Writer) error {
+				return rootfs.WriteLayerTar(w, upper)
+			})
+		})
+
+	case "COPY":
+		paths, names, err := b.copySources(inst.Args, st.config.WorkingDir)
+		if err != nil {
+			return err
+		}
+		inputs, err := hashInputs(paths)
+		if err != nil {
+			return err
+		}
+		st.key = cacheKey(st.key, inst.String()+"\n"+inputs)
+		return b.addLayer(st, func() (string, error) {
+			return addLayerFrom(func(w io.Writer) error {
+				return chownTar(w, func(w io.Writer) error {
+					return rootfs.WriteTarPaths(w, paths, names)
+				})
+			})
+		})
+	}
+	return fmt.Errorf("unsupported instruction")
+}
+
+// addLayer appends the layer cached under st.key, or creates and caches it
+func (b *Builder) addLayer(st *state, create func() (string, error)) error {
+	if !b.NoCache {
+		if digest, ok := cachedLayer(st.key); ok {
+			fmt.Fprintln(b.Out, " ---> Using cache")
+			st.layers = append(st.layers, digest)
+			return nil
+		}
+	}
+
+	digest, err := create()
+	if err != nil {
+		return err
+	}
+	if err := storeCachedLayer(st.key, digest); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot update build cache: %v\n", err)
+	}
+	fmt.Fprintf(b.Out, " ---> %s\n", digest[:12])
+	st.layers = append(st.layers, digest)
+	return nil
+}
+
+// copySources resolves the sources of a COPY instruction inside the build
+// context and the archive name each one is stored under
+func (b *Builder) copySources(args, workdir string) ([]string, []string, error) {
+	var fields []string
+	if strings.HasPrefix(args, "[") {
+		if err := json.Unmarshal([]byte(args), &fields); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		fields = strings.Fields(args)
+	}
+	if len(fields) < 2 {
+		return nil, nil, fmt.Errorf("COPY needs at least one source and a destination")
+	}
+
+	srcs, dest := fields[:len(fields)-1], fields[len(fields)-1]
+	if workdir == "" {
+		workdir = "/"
+	}
+	destDir := strings.HasSuffix(dest, "/") || dest == "." || strings.HasSuffix(dest, "/.") || len(srcs) > 1
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(workdir, dest)
+	}
+
+	context, err := filepath.Abs(b.ContextDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var paths, names []string
+	for _, src := range srcs {
+		matches, err := filepath.Glob(filepath.Join(context, src))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(matches) == 0 {
+			return nil, nil, fmt.Errorf("%s: no such file or directory in build context", src)
+		}
+		for _, path := range matches {
+			if rel, err := filepath.Rel(context, path); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				return nil, nil, fmt.Errorf("%s is outside the build context", src)
+			}
+			fi, err := os.Lstat(path)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			// Directories copy their contents; files land in dest if it is
+			// a directory, otherwise at dest itself
+			name := dest
+			if !fi.IsDir() && (destDir || len(matches) > 1) {
+				name = filepath.Join(dest, filepath.Base(path))
+			}
+			paths = append(paths, path)
+			names = append(names, strings.TrimPrefix(name, "/"))
+		}
+	}
+	return paths, names, nil
+}
+
+// addLayerFrom stores the tar stream produced by write as a new layer
+func addLayerFrom(write func(w io.Writer) error) (string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+	digest, err := image.AddLayer(pr)
+	pr.CloseWithError(err)
+	return digest, err
+}
+
+// chownTar rewrites the archive produced by write so everything is owned by
+// root, as files copied from the build context should be
+func chownTar(w io.Writer, write func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+	defer pr.Close()
+
+	tr := tar.NewReader(pr)
+	tw := tar.NewWriter(w)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
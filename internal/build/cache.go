@@ -0,0 +1,83 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gocount/internal/image"
+)
+
+// cacheDir maps build cache keys to the layer digests they produced
+var cacheDir = filepath.Join(image.Root, "buildcache")
+
+// cacheKey chains the key of the previous steps with the next step
+func cacheKey(prev, step string) string {
+	sum := sha256.Sum256([]byte(prev + "\n" + step))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedLayer returns the layer built for key, if it is still stored
+func cachedLayer(key string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(cacheDir, key))
+	if err != nil {
+		return "", false
+	}
+	digest := strings.TrimSpace(string(data))
+	if _, err := os.Stat(image.LayerDir(digest)); err != nil {
+		return "", false
+	}
+	return digest, true
+}
+
+func storeCachedLayer(key, digest string) error {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cacheDir, key), []byte(digest+"\n"), 0644)
+}
+
+// hashInputs digests the names, modes, link targets and contents of the
+// files under paths, so COPY is only cached while its sources are unchanged
+func hashInputs(paths []string) (string, error) {
+	h := sha256.New()
+	for i, root := range paths {
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%d\x00%s\x00%o\x00", i, rel, fi.Mode())
+
+			switch {
+			case fi.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, "%s\x00", link)
+			case fi.Mode().IsRegular():
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				if _, err := io.Copy(h, f); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,88 @@
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Instruction is one line of a Gocountfile
+type Instruction struct {
+	Keyword string // upper-cased, e.g. "RUN"
+	Args    string
+	Line    int
+}
+
+func (i Instruction) String() string {
+	return i.Keyword + " " + i.Args
+}
+
+// Supported Gocountfile instructions
+var keywords = map[string]bool{
+	"FROM":       true,
+	"RUN":        true,
+	"COPY":       true,
+	"ENV":        true,
+	"WORKDIR":    true,
+	"CMD":        true,
+	"ENTRYPOINT": true,
+}
+
+// Parse reads a Gocountfile. Blank lines and "#" comments are skipped and a
+// trailing backslash continues an instruction on the next line.
+func Parse(r io.Reader) ([]Instruction, error) {
+	var instructions []Instruction
+	var current strings.Builder
+	start := 0
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if current.Len() == 0 && (line == "" || strings.HasPrefix(line, "#")) {
+			continue
+		}
+		if current.Len() == 0 {
+			start = n
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+
+		inst, err := parseLine(current.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, inst)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		return nil, fmt.Errorf("line %d: unterminated line continuation", start)
+	}
+
+	if len(instructions) == 0 || instructions[0].Keyword != "FROM" {
+		return nil, fmt.Errorf("a Gocountfile must start with FROM")
+	}
+	return instructions, nil
+}
+
+func parseLine(line string, n int) (Instruction, error) {
+	keyword, args, _ := strings.Cut(line, " ")
+	keyword = strings.ToUpper(keyword)
+	args = strings.TrimSpace(args)
+
+	if !keywords[keyword] {
+		return Instruction{}, fmt.Errorf("line %d: unknown instruction %s", n, keyword)
+	}
+	if args == "" {
+		return Instruction{}, fmt.Errorf("line %d: %s requires arguments", n, keyword)
+	}
+	return Instruction{Keyword: keyword, Args: args, Line: n}, nil
+}
@@ -1,11 +1,17 @@
 package cgroups
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"gocount/internal/paths"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -13,17 +19,86 @@ const (
 	Prefix     = "gocount"
 )
 
+// Base returns the cgroup that container cgroups are created in. Without
+// root it is under the subtree delegated to the user, such as
+// user@UID.service under systemd.
+func Base() (string, error) {
+	if !paths.Rootless() {
+		return filepath.Join(CgroupRoot, Prefix), nil
+	}
+	delegated, err := delegatedCgroup()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(delegated, Prefix), nil
+}
+
+// delegatedCgroup returns the highest writable cgroup above our own. The
+// kernel only lets us move processes between cgroups under it.
+func delegatedCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	var own string
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			own = filepath.Join(CgroupRoot, path)
+		}
+	}
+	if own == "" {
+		return "", fmt.Errorf("no cgroup v2 hierarchy")
+	}
+	if !writable(own) {
+		return "", fmt.Errorf("cgroup %s is not delegated to us (try systemd-run --user --scope)", own)
+	}
+
+	dir := own
+	for parent := filepath.Dir(dir); parent != CgroupRoot && writable(parent); parent = filepath.Dir(dir) {
+		dir = parent
+	}
+	return dir, nil
+}
+
+// writable reports whether we may create cgroups in dir and move
+// processes into it
+func writable(dir string) bool {
+	return unix.Access(dir, unix.W_OK) == nil &&
+		unix.Access(filepath.Join(dir, "cgroup.procs"), unix.W_OK) == nil
+}
+
 func EnsureCgroupRoot() error {
-	rootPath := filepath.Join(CgroupRoot, Prefix)
+	rootPath, err := Base()
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(rootPath); os.IsNotExist(err) {
 		if err := os.MkdirAll(rootPath, 0755); err != nil {
 			return fmt.Errorf("cannot create cgroup root: %w", err)
 		}
 	}
 
-	// Enable controllers in the parent cgroup
+	// Enable controllers in the parent cgroup. A delegated subtree only
+	// has those the system gave the user.
+	controllers := "+cpu +memory +pids"
+	if paths.Rootless() {
+		data, err := os.ReadFile(filepath.Join(rootPath, "cgroup.controllers"))
+		if err != nil {
+			return err
+		}
+		var available []string
+		for _, name := range strings.Fields(string(data)) {
+			if name == "cpu" || name == "memory" || name == "pids" {
+				available = append(available, "+"+name)
+			}
+		}
+		controllers = strings.Join(available, " ")
+	}
+	if controllers == "" {
+		return nil
+	}
 	subtreeControl := filepath.Join(rootPath, "cgroup.subtree_control")
-	if err := writeFile(subtreeControl, "+cpu +memory +pids"); err != nil {
+	if err := writeFile(subtreeControl, controllers); err != nil {
 		return fmt.Errorf("cannot enable controllers: %w", err)
 	}
 
@@ -34,7 +109,11 @@ func Create(id string) (string, error) {
 	if err := EnsureCgroupRoot(); err != nil {
 		return "", err
 	}
-	path := filepath.Join(CgroupRoot, Prefix, id)
+	base, err := Base()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(base, id)
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return "", fmt.Errorf("mkdir cgroup: %w", err)
 	}
@@ -98,10 +177,24 @@ func AddProc(cgPath string, pid int) error {
 	return writeFile(filepath.Join(cgPath, "cgroup.procs"), strconv.Itoa(pid))
 }
 
-// Delete removes the created cgroup directory (must be empty of procs)
+// Delete removes the created cgroup directory. Processes that were just
+// killed keep it busy until they exit, so it waits a little for them.
 func Delete(id string) error {
-	path := filepath.Join(CgroupRoot, Prefix, id)
-	return os.Remove(path)
+	base, err := Base()
+	if err != nil {
+		return err
+	}
+	cgPath := filepath.Join(base, id)
+	for i := 0; ; i++ {
+		err := os.Remove(cgPath)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		if !errors.Is(err, unix.EBUSY) || i == 100 {
+			return fmt.Errorf("remove cgroup %s: %w", cgPath, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
 // helper - don't use O_CREATE for cgroup files, they already exist
@@ -118,3 +211,33 @@ func writeFile(path, content string) error {
 	}
 	return nil
 }
+
+// Freeze suspends (or with frozen=false resumes) every process in the
+// cgroup. Freezing returns once the kernel reports all of them stopped.
+func Freeze(cgPath string, frozen bool) error {
+	val := "0"
+	if frozen {
+		val = "1"
+	}
+	if err := writeFile(filepath.Join(cgPath, "cgroup.freeze"), val); err != nil {
+		return err
+	}
+	if !frozen {
+		return nil
+	}
+
+	for i := 0; i < 500; i++ {
+		data, err := os.ReadFile(filepath.Join(cgPath, "cgroup.events"))
+		if err != nil {
+			return fmt.Errorf("read cgroup.events: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "frozen 1" {
+				return nil
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	writeFile(filepath.Join(cgPath, "cgroup.freeze"), "0")
+	return fmt.Errorf("timed out freezing %s", cgPath)
+}
@@ -0,0 +1,225 @@
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Wildcard matches any major or minor number in a DeviceRule
+const Wildcard = -1
+
+// DeviceRule allows access to matching devices
+type DeviceRule struct {
+	Type   rune // 'c', 'b' or 'a' for both
+	Major  int64
+	Minor  int64
+	Access string // any of "rwm"
+}
+
+// DefaultDeviceRules allows the nodes every container gets in /dev, plus
+// mknod of any device (using one still needs a rule)
+var DefaultDeviceRules = []DeviceRule{
+	{'c', Wildcard, Wildcard, "m"},
+	{'b', Wildcard, Wildcard, "m"},
+	{'c', 1, 3, "rwm"},          // null
+	{'c', 1, 5, "rwm"},          // zero
+	{'c', 1, 7, "rwm"},          // full
+	{'c', 1, 8, "rwm"},          // random
+	{'c', 1, 9, "rwm"},          // urandom
+	{'c', 5, 0, "rwm"},          // tty
+	{'c', 5, 1, "rwm"},          // console
+	{'c', 5, 2, "rwm"},          // ptmx
+	{'c', 136, Wildcard, "rwm"}, // pts/*
+}
+
+// SetDevices attaches a device controller program to the cgroup that only
+// allows devices matching one of rules
+func SetDevices(cgPath string, rules []DeviceRule) error {
+	insns, err := deviceFilter(rules)
+	if err != nil {
+		return err
+	}
+	prog, err := loadDeviceProgram(insns)
+	if err != nil {
+		return fmt.Errorf("cannot load device filter: %w", err)
+	}
+	defer unix.Close(prog)
+
+	dir, err := os.Open(cgPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	attr := struct {
+		targetFd    uint32
+		attachBpfFd uint32
+		attachType  uint32
+		attachFlags uint32
+	}{uint32(dir.Fd()), uint32(prog), unix.BPF_CGROUP_DEVICE, unix.BPF_F_ALLOW_MULTI}
+	if _, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr)); errno != 0 {
+		return fmt.Errorf("cannot attach device filter to %s: %w", cgPath, errno)
+	}
+	return nil
+}
+
+// bpfInsn is one eBPF instruction
+type bpfInsn struct {
+	code uint8
+	regs uint8 // src << 4 | dst
+	off  int16
+	imm  int32
+}
+
+// eBPF opcodes used by the device filter
+const (
+	ldxW    = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+	andImm  = unix.BPF_ALU64 | unix.BPF_AND | unix.BPF_K
+	rshImm  = unix.BPF_ALU64 | unix.BPF_RSH | unix.BPF_K
+	movReg  = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X
+	movImm  = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+	jneImm  = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+	jneReg  = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_X
+	exitOp  = unix.BPF_JMP | unix.BPF_EXIT
+	regCtx  = 1
+	regType = 2
+	regAcc  = 3
+	regMaj  = 4
+	regMin  = 5
+)
+
+func insn(code uint8, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: src<<4 | dst, off: off, imm: imm}
+}
+
+// deviceFilter compiles rules into a BPF_PROG_TYPE_CGROUP_DEVICE program.
+// The context is struct bpf_cgroup_dev_ctx { u32 access_type; u32 major;
+// u32 minor; } with the device type in the low 16 bits of access_type.
+func deviceFilter(rules []DeviceRule) ([]bpfInsn, error) {
+	prog := []bpfInsn{
+		insn(ldxW, regType, regCtx, 0, 0),
+		insn(andImm, regType, 0, 0, 0xffff),
+		insn(ldxW, regAcc, regCtx, 0, 0),
+		insn(rshImm, regAcc, 0, 0, 16),
+		insn(ldxW, regMaj, regCtx, 4, 0),
+		insn(ldxW, regMin, regCtx, 8, 0),
+	}
+
+	for _, rule := range rules {
+		var checks [][]bpfInsn
+		switch rule.Type {
+		case 'c':
+			checks = append(checks, []bpfInsn{insn(jneImm, regType, 0, 0, unix.BPF_DEVCG_DEV_CHAR)})
+		case 'b':
+			checks = append(checks, []bpfInsn{insn(jneImm, regType, 0, 0, unix.BPF_DEVCG_DEV_BLOCK)})
+		case 'a':
+		default:
+			return nil, fmt.Errorf("invalid device type %q", rule.Type)
+		}
+
+		access, err := deviceAccess(rule.Access)
+		if err != nil {
+			return nil, err
+		}
+		if access != unix.BPF_DEVCG_ACC_MKNOD|unix.BPF_DEVCG_ACC_READ|unix.BPF_DEVCG_ACC_WRITE {
+			// Every requested access bit must be allowed
+			checks = append(checks, []bpfInsn{
+				insn(movReg, regCtx, regAcc, 0, 0),
+				insn(andImm, regCtx, 0, 0, access),
+				insn(jneReg, regCtx, regAcc, 0, 0),
+			})
+		}
+		if rule.Major != Wildcard {
+			checks = append(checks, []bpfInsn{insn(jneImm, regMaj, 0, 0, int32(rule.Major))})
+		}
+		if rule.Minor != Wildcard {
+			checks = append(checks, []bpfInsn{insn(jneImm, regMin, 0, 0, int32(rule.Minor))})
+		}
+
+		// Each failed check jumps past the rest of this rule's block,
+		// which ends by returning 1 (allow)
+		var block []bpfInsn
+		for _, check := range checks {
+			block = append(block, check...)
+		}
+		block = append(block, insn(movImm, 0, 0, 0, 1), insn(exitOp, 0, 0, 0, 0))
+		for i := range block {
+			if block[i].code == jneImm || block[i].code == jneReg {
+				block[i].off = int16(len(block) - i - 1)
+			}
+		}
+		prog = append(prog, block...)
+	}
+
+	// No rule matched: deny
+	return append(prog, insn(movImm, 0, 0, 0, 0), insn(exitOp, 0, 0, 0, 0)), nil
+}
+
+// deviceAccess converts "rwm" to BPF_DEVCG_ACC_* bits
+func deviceAccess(s string) (int32, error) {
+	var access int32
+	for _, c := range s {
+		switch c {
+		case 'r':
+			access |= unix.BPF_DEVCG_ACC_READ
+		case 'w':
+			access |= unix.BPF_DEVCG_ACC_WRITE
+		case 'm':
+			access |= unix.BPF_DEVCG_ACC_MKNOD
+		default:
+			return 0, fmt.Errorf("invalid device access %q", s)
+		}
+	}
+	if access == 0 {
+		return 0, fmt.Errorf("invalid device access %q", s)
+	}
+	return access, nil
+}
+
+// ValidDeviceAccess reports whether s is a non-empty combination of "rwm"
+func ValidDeviceAccess(s string) bool {
+	_, err := deviceAccess(s)
+	return err == nil
+}
+
+// loadDeviceProgram loads insns as a cgroup device program and returns its fd
+func loadDeviceProgram(insns []bpfInsn) (int, error) {
+	license := []byte("Apache-2.0\x00")
+	logBuf := make([]byte, 64*1024)
+
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(logBuf)
+	if errno != 0 {
+		if log := strings.TrimRight(string(logBuf), "\x00"); log != "" {
+			return -1, fmt.Errorf("%w: %s", errno, log)
+		}
+		return -1, errno
+	}
+	return int(fd), nil
+}
@@ -0,0 +1,40 @@
+// Package config reads the defaults for new containers from the config file
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gocount/internal/paths"
+)
+
+// Config holds defaults that run flags override
+type Config struct {
+	// Ulimits apply to every container unless --ulimit sets the same
+	// resource, in --ulimit syntax
+	Ulimits []string `json:"ulimits"`
+}
+
+// Default is used for settings missing from the config file. Programs
+// that select() on file descriptors break above 1024 open files, so that
+// is the soft limit; the hard limit leaves room to raise it.
+var Default = Config{
+	Ulimits: []string{"nofile=1024:524288"},
+}
+
+// Load reads paths.ConfigFile. Without one the defaults are used.
+func Load() (*Config, error) {
+	cfg := Default
+	data, err := os.ReadFile(paths.ConfigFile)
+	if os.IsNotExist(err) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config: %v", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", paths.ConfigFile, err)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,218 @@
+package container
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capabilities maps names to capability numbers
+var capabilities = map[string]int{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// DefaultCapabilities is what containers keep of root's capabilities, the
+// same set as Docker
+var DefaultCapabilities = []string{
+	"CAP_AUDIT_WRITE",
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_MKNOD",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_RAW",
+	"CAP_SETFCAP",
+	"CAP_SETGID",
+	"CAP_SETPCAP",
+	"CAP_SETUID",
+	"CAP_SYS_CHROOT",
+}
+
+// AllCapabilities returns the name of every known capability
+func AllCapabilities() []string {
+	var names []string
+	for name := range capabilities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// normalizeCap accepts "net_admin", "NET_ADMIN" or "CAP_NET_ADMIN"
+func normalizeCap(name string) (string, error) {
+	name = strings.ToUpper(name)
+	if name == "ALL" {
+		return name, nil
+	}
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	if _, ok := capabilities[name]; !ok {
+		return "", fmt.Errorf("unknown capability %q", name)
+	}
+	return name, nil
+}
+
+// Capabilities returns the default capabilities adjusted by add and drop.
+// Either may contain "ALL"; drops are applied before adds.
+func Capabilities(add, drop []string) ([]string, error) {
+	set := map[string]bool{}
+	for _, name := range DefaultCapabilities {
+		set[name] = true
+	}
+
+	for _, name := range drop {
+		name, err := normalizeCap(name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "ALL" {
+			set = map[string]bool{}
+		}
+		delete(set, name)
+	}
+	for _, name := range add {
+		name, err := normalizeCap(name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "ALL" {
+			for name := range capabilities {
+				set[name] = true
+			}
+		}
+		set[name] = true
+	}
+	delete(set, "ALL")
+
+	// Not nil even when empty: nil means a container from before
+	// capabilities were dropped, which keeps all of them
+	names := []string{}
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ApplyCapabilities limits the calling thread to names in the bounding,
+// effective, permitted, inheritable and ambient sets. Call it right
+// before exec, from the thread that execs. Like Docker, users other than
+// root get no ambient capabilities, so their command starts without any.
+func ApplyCapabilities(names []string) error {
+	var keep uint64
+	for _, name := range names {
+		c, ok := capabilities[name]
+		if !ok {
+			return fmt.Errorf("unknown capability %q", name)
+		}
+		keep |= 1 << uint(c)
+	}
+
+	// We cannot gain capabilities, so --privileged keeps what we have
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capget: %v", err)
+	}
+	keep &= uint64(data[1].Permitted)<<32 | uint64(data[0].Permitted)
+
+	// The kernel may know fewer capabilities than we do, or more
+	for c := 0; ; c++ {
+		if _, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, uintptr(c), 0, 0, 0); err != nil {
+			break
+		}
+		if keep&(1<<uint(c)) == 0 {
+			if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil {
+				return fmt.Errorf("cannot drop capability %d from bounding set: %v", c, err)
+			}
+		}
+	}
+
+	for i := range data {
+		word := uint32(keep >> (32 * i))
+		data[i] = unix.CapUserData{Effective: word, Permitted: word, Inheritable: word}
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capset: %v", err)
+	}
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("cannot clear ambient capabilities: %v", err)
+	}
+	if unix.Getuid() != 0 {
+		return nil
+	}
+	for _, name := range names {
+		c := capabilities[name]
+		if keep&(1<<uint(c)) == 0 {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("cannot raise ambient %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// CapabilityNames decodes a capability mask such as CapEff in
+// /proc/<pid>/status
+func CapabilityNames(hex string) ([]string, error) {
+	mask, err := strconv.ParseUint(hex, 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, c := range capabilities {
+		if mask&(1<<uint(c)) != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -5,7 +5,12 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"gocount/internal/paths"
+	"gocount/internal/rootfs"
+	"gocount/internal/seccomp"
 )
 
 type Container struct {
@@ -15,6 +20,72 @@ type Container struct {
 	Status  string
 	RootFs  string
 	Cgroup  string
+
+	// Image is set for containers started from an image. LowerDirs are the
+	// layers the container was created from, topmost first: RootFs is an
+	// overlay of them with a private UpperDir, or without one a full copy.
+	Image     string   `json:",omitempty"`
+	LowerDirs []string `json:",omitempty"`
+	UpperDir  string   `json:",omitempty"`
+	WorkDir   string   `json:",omitempty"`
+
+	// Set when the writable layer is limited by --storage-size: the upper
+	// dir lives on a loop-mounted ext4 image of StorageSize bytes, stored
+	// next to StorageDir with an ".img" suffix
+	StorageSize int64  `json:",omitempty"`
+	StorageDir  string `json:",omitempty"`
+
+	ReadOnly      bool     `json:",omitempty"`
+	ReadOnlyTmpfs bool     `json:",omitempty"`
+	Mounts        []Mount  `json:",omitempty"`
+	Tmpfs         []Tmpfs  `json:",omitempty"`
+	ShmSize       int64    `json:",omitempty"`
+	Devices       []Device `json:",omitempty"`
+
+	// --privileged disables the masked and read-only kernel paths
+	Privileged    bool     `json:",omitempty"`
+	MaskedPaths   []string `json:",omitempty"`
+	ReadonlyPaths []string `json:",omitempty"`
+
+	// Id maps of the container's user namespace, none without --userns
+	UIDMap []IDMap `json:",omitempty"`
+	GIDMap []IDMap `json:",omitempty"`
+
+	// Rootless containers are run by a regular user: the overlay is
+	// mounted by the child inside its user namespace
+	Rootless bool   `json:",omitempty"`
+	Network  string `json:",omitempty"`
+
+	// Capabilities kept by the container process. Nil for containers from
+	// before capabilities were dropped, which keep all of root's.
+	Capabilities []string
+
+	// Seccomp profile: empty for the default, "unconfined", or the file a
+	// custom profile was loaded from, kept in SeccompRules. SeccompLog
+	// logs what the profile would block instead of blocking it.
+	SeccompProfile string           `json:",omitempty"`
+	SeccompRules   *seccomp.Profile `json:",omitempty"`
+	SeccompLog     bool             `json:",omitempty"`
+
+	// NoNewPrivileges sets no_new_privs for the container process, so
+	// setuid binaries and file capabilities cannot raise its privileges.
+	// NoSuid mounts the rootfs nosuid as well.
+	NoNewPrivileges bool `json:",omitempty"`
+	NoSuid          bool `json:",omitempty"`
+
+	// User runs the command as user[:group] instead of root
+	User string `json:",omitempty"`
+
+	// Env is the command's whole environment, nil for containers from
+	// before it was recorded. WorkingDir is its cwd, / if empty.
+	Env        []string `json:",omitempty"`
+	WorkingDir string   `json:",omitempty"`
+	Hostname   string   `json:",omitempty"`
+	Domainname string   `json:",omitempty"`
+
+	// Ulimits are the resource limits of the command: the config file's
+	// defaults adjusted by --ulimit
+	Ulimits []Ulimit `json:",omitempty"`
 }
 
 var Containers = map[string]*Container{}
@@ -38,20 +109,96 @@ func AddContainer(id string, pid int, command []string, rootfs string) {
 	}
 	fmt.Println("Container", id, "registered")
 }
+
+// Lookup finds a container by ID in memory or on disk
+func Lookup(id string) (*Container, error) {
+	if c, ok := Containers[id]; ok {
+		return c, nil
+	}
+	containers, _ := LoadContainers()
+	for _, c := range containers {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("container not found: %s", id)
+}
+
+// MountRootfs (re)mounts the storage and overlay of a container if needed.
+// The overlay of a rootless container can only be mounted inside its user
+// namespace, so it is not visible on the host: see PrepareRootfs.
+func (c *Container) MountRootfs() error {
+	if c.Rootless && c.UpperDir != "" {
+		return fmt.Errorf("container %s is rootless, its rootfs is only mounted inside the container", c.ID)
+	}
+	if c.StorageDir != "" && !rootfs.IsMountpoint(c.StorageDir) {
+		if err := rootfs.MountStorage(c.StorageDir+".img", c.StorageSize, c.StorageDir); err != nil {
+			return err
+		}
+	}
+	if c.UpperDir == "" || rootfs.IsMountpoint(c.RootFs) {
+		return nil
+	}
+	return rootfs.MountOverlay(c.LowerDirs, c.UpperDir, c.WorkDir, c.RootFs)
+}
+
+// PrepareRootfs mounts what a container needs before it is started. The
+// child mounts the overlay of rootless containers itself.
+func (c *Container) PrepareRootfs() error {
+	if c.Rootless {
+		return nil
+	}
+	return c.MountRootfs()
+}
+
+// MountOptions returns the options the container's root is set up with
+func (c *Container) MountOptions() MountOptions {
+	opts := MountOptions{
+		ReadOnly:      c.ReadOnly,
+		ReadOnlyTmpfs: c.ReadOnlyTmpfs,
+		Mounts:        c.Mounts,
+		Tmpfs:         c.Tmpfs,
+		ShmSize:       c.ShmSize,
+		Devices:       c.Devices,
+		MaskedPaths:   c.MaskedPaths,
+		ReadonlyPaths: c.ReadonlyPaths,
+		Privileged:    c.Privileged,
+		NoSuid:        c.NoSuid,
+		UserNS:        c.UserNS(),
+	}
+	if c.Rootless {
+		opts.LowerDirs, opts.UpperDir, opts.WorkDir = c.LowerDirs, c.UpperDir, c.WorkDir
+	}
+	return opts
+}
+
+// UnmountRootfs detaches everything MountRootfs mounted
+func (c *Container) UnmountRootfs() error {
+	if c.UpperDir != "" {
+		if err := rootfs.Unmount(c.RootFs); err != nil {
+			return err
+		}
+	}
+	if c.StorageDir != "" {
+		return rootfs.Unmount(c.StorageDir)
+	}
+	return nil
+}
+
 func SaveContainer(c *Container) error {
 	data, _ := json.Marshal(c)
-	path := fmt.Sprintf("/tmp/gocount/%s.json", c.ID)
+	path := filepath.Join(paths.Root, c.ID+".json")
 	return os.WriteFile(path, data, 0644)
 }
 
 func LoadContainers() ([]*Container, error) {
 	var containers []*Container
-	files, _ := os.ReadDir("/tmp/gocount")
+	files, _ := os.ReadDir(paths.Root)
 	for _, f := range files {
 		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
 			continue
 		}
-		data, err := os.ReadFile("/tmp/gocount/" + f.Name())
+		data, err := os.ReadFile(filepath.Join(paths.Root, f.Name()))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: could not read %s: %v\n", f.Name(), err)
 			continue
@@ -0,0 +1,125 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"gocount/internal/cgroups"
+	"gocount/internal/rootfs"
+
+	"golang.org/x/sys/unix"
+)
+
+// Device is a host device node recreated inside the container
+type Device struct {
+	HostPath string
+	Path     string // inside the container
+	Type     string // "c" or "b"
+	Major    int64
+	Minor    int64
+	FileMode uint32 // permission bits
+	Uid      uint32
+	Gid      uint32
+	Access   string // any of "rwm"
+}
+
+// ParseDevice parses "host[:container][:rwm]" and stats the host device
+func ParseDevice(spec string) (Device, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return Device{}, fmt.Errorf("invalid device %q: expected host[:container][:rwm]", spec)
+	}
+
+	d := Device{HostPath: parts[0], Path: parts[0], Access: "rwm"}
+	switch len(parts) {
+	case 2:
+		// The second part is either the container path or the access
+		if cgroups.ValidDeviceAccess(parts[1]) {
+			d.Access = parts[1]
+		} else {
+			d.Path = parts[1]
+		}
+	case 3:
+		d.Path, d.Access = parts[1], parts[2]
+	}
+	if !filepath.IsAbs(d.HostPath) || !filepath.IsAbs(d.Path) {
+		return Device{}, fmt.Errorf("invalid device %q: paths must be absolute", spec)
+	}
+	if !cgroups.ValidDeviceAccess(d.Access) {
+		return Device{}, fmt.Errorf("invalid device %q: access must be a combination of r, w and m", spec)
+	}
+	d.Path = filepath.Clean(d.Path)
+
+	var st unix.Stat_t
+	if err := unix.Stat(d.HostPath, &st); err != nil {
+		return Device{}, fmt.Errorf("invalid device %q: %v", spec, err)
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		d.Type = "c"
+	case unix.S_IFBLK:
+		d.Type = "b"
+	default:
+		return Device{}, fmt.Errorf("invalid device %q: %s is not a device", spec, d.HostPath)
+	}
+	d.Major, d.Minor = int64(unix.Major(st.Rdev)), int64(unix.Minor(st.Rdev))
+	d.FileMode = st.Mode & 07777
+	d.Uid, d.Gid = st.Uid, st.Gid
+	return d, nil
+}
+
+// Rule returns the device controller rule that allows d
+func (d Device) Rule() cgroups.DeviceRule {
+	return cgroups.DeviceRule{Type: rune(d.Type[0]), Major: d.Major, Minor: d.Minor, Access: d.Access}
+}
+
+// DeviceRules returns the default allowlist plus the container's devices
+func (c *Container) DeviceRules() []cgroups.DeviceRule {
+	rules := append([]cgroups.DeviceRule{}, cgroups.DefaultDeviceRules...)
+	for _, d := range c.Devices {
+		rules = append(rules, d.Rule())
+	}
+	return rules
+}
+
+// createDevices makes the requested device nodes in the rootfs, or bind
+// mounts the host's in a user namespace. Runs before pivot_root, after the
+// /dev tmpfs mount.
+func createDevices(rootfsPath string, devices []Device, userns bool) error {
+	for _, d := range devices {
+		path, err := rootfs.SecureJoin(rootfsPath, d.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %v", filepath.Dir(d.Path), err)
+		}
+		os.Remove(path)
+		if userns {
+			if err := bindDevice(d.HostPath, path); err != nil {
+				return fmt.Errorf("bind %s: %v", d.Path, err)
+			}
+			continue
+		}
+
+		mode := d.FileMode | syscall.S_IFCHR
+		if d.Type == "b" {
+			mode = d.FileMode | syscall.S_IFBLK
+		}
+		dev := int(unix.Mkdev(uint32(d.Major), uint32(d.Minor)))
+		if err := syscall.Mknod(path, mode, dev); err != nil {
+			return fmt.Errorf("mknod %s: %v", d.Path, err)
+		}
+		if err := os.Chown(path, int(d.Uid), int(d.Gid)); err != nil {
+			return fmt.Errorf("chown %s: %v", d.Path, err)
+		}
+		// mknod applies the umask
+		if err := syscall.Chmod(path, d.FileMode); err != nil {
+			return fmt.Errorf("chmod %s: %v", d.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultPath is PATH for containers whose image does not set one
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// DefaultEnv is the environment every container starts from
+func DefaultEnv(hostname string) []string {
+	return []string{"PATH=" + DefaultPath, "HOSTNAME=" + hostname}
+}
+
+// MergeEnv returns base with the KEY=VALUE entries of each override list
+// applied in order, replacing earlier values of the same key
+func MergeEnv(base []string, overrides ...[]string) []string {
+	env := append([]string{}, base...)
+	index := map[string]int{}
+	for i, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		index[key] = i
+	}
+	for _, list := range overrides {
+		for _, kv := range list {
+			key, _, _ := strings.Cut(kv, "=")
+			if i, ok := index[key]; ok {
+				env[i] = kv
+				continue
+			}
+			index[key] = len(env)
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// ParseEnv checks -e style entries. "KEY=VALUE" is used as is, a bare
+// "KEY" takes the value from our own environment and is dropped if unset.
+func ParseEnv(entries []string) ([]string, error) {
+	var env []string
+	for _, entry := range entries {
+		key, _, hasValue := strings.Cut(entry, "=")
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid environment variable %q", entry)
+		}
+		if hasValue {
+			env = append(env, entry)
+		} else if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	return env, nil
+}
+
+// ReadEnvFile reads a file of KEY=VALUE lines, as accepted by ParseEnv.
+// Blank lines and lines starting with # are skipped.
+func ReadEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read env file: %v", err)
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read env file: %v", err)
+	}
+	env, err := ParseEnv(entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return env, nil
+}
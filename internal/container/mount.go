@@ -6,19 +6,59 @@ import (
 	"path/filepath"
 	"syscall"
 
+	"gocount/internal/rootfs"
+
 	"golang.org/x/sys/unix"
 )
 
-func SetupMount(rootfs string) error {
+// MountOptions controls how SetupMount prepares the container's root
+type MountOptions struct {
+	// ReadOnly remounts the root read-only once /proc, /sys and /dev are set up
+	ReadOnly bool
+	// ReadOnlyTmpfs mounts writable tmpfs on /tmp and /run of a read-only root
+	ReadOnlyTmpfs bool
+	// Mounts are bind mounted into the rootfs before pivot_root
+	Mounts []Mount
+	// Tmpfs are mounted inside the container after pivot_root
+	Tmpfs []Tmpfs
+	// ShmSize limits /dev/shm, DefaultShmSize if zero
+	ShmSize int64
+	// Devices are host device nodes recreated in the container
+	Devices []Device
+	// MaskedPaths are hidden and ReadonlyPaths made read-only, see
+	// SecurityPaths
+	MaskedPaths   []string
+	ReadonlyPaths []string
+	// Privileged leaves /sys and /sys/fs/cgroup writable
+	Privileged bool
+	// NoSuid mounts the root nosuid, so setuid binaries run unprivileged
+	NoSuid bool
+	// UserNS means we run in a user namespace and cannot create device
+	// nodes, so host ones are bind mounted instead
+	UserNS bool
+	// LowerDirs, UpperDir and WorkDir describe an overlay to mount on the
+	// rootfs first, for rootless containers
+	LowerDirs []string
+	UpperDir  string
+	WorkDir   string
+}
+
+func SetupMount(rootfs string, opts MountOptions) error {
 	// Get absolute path
 	rootfs, err := filepath.Abs(rootfs)
 	if err != nil {
 		return fmt.Errorf("failed to get absolute path: %v", err)
 	}
 
-	// Make current mount propagation private (required for pivot_root)
-	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
-		return fmt.Errorf("failed to make / private: %v", err)
+	// Stop our mounts from propagating to the host (required for
+	// pivot_root). Slave rather than private so rslave volumes still see
+	// mounts made on the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_SLAVE, ""); err != nil {
+		return fmt.Errorf("failed to make / slave: %v", err)
+	}
+
+	if err := mountRootlessOverlay(rootfs, opts); err != nil {
+		return err
 	}
 
 	// Bind mount rootfs to itself (required before pivot_root)
@@ -26,6 +66,36 @@ func SetupMount(rootfs string) error {
 	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
 		return fmt.Errorf("failed to bind mount rootfs: %v", err)
 	}
+	// The root itself must not follow host unmounts of the rootfs
+	if err := syscall.Mount("", rootfs, "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make rootfs private: %v", err)
+	}
+	if opts.NoSuid {
+		if err := syscall.Mount("", rootfs, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_NOSUID, ""); err != nil {
+			return fmt.Errorf("failed to remount rootfs nosuid: %v", err)
+		}
+	}
+
+	if err := mountVolumes(rootfs, opts.Mounts); err != nil {
+		return err
+	}
+
+	// resolv.conf is bind mounted so it works on a read-only root and
+	// never writes through a symlink in the image
+	if err := setupDNS(rootfs); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: DNS setup failed: %v\n", err)
+	}
+
+	// proc and sysfs are mounted while the host's are still visible: in a
+	// user namespace the kernel only allows them next to an existing mount
+	if err := mountKernelFS(rootfs, opts.Privileged); err != nil {
+		return err
+	}
+
+	// /dev is populated while the host's device nodes are still reachable
+	if err := setupDev(rootfs, opts); err != nil {
+		return err
+	}
 
 	// Create directory for old root
 	putold := filepath.Join(rootfs, ".pivot_root")
@@ -53,48 +123,132 @@ func SetupMount(rootfs string) error {
 		return fmt.Errorf("failed to remove old root: %v", err)
 	}
 
-	// === NEW: Setup DNS before mounting filesystems ===
-	if err := setupDNS(); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: DNS setup failed: %v\n", err)
+	if err := maskPaths(opts.MaskedPaths); err != nil {
+		return err
+	}
+	if err := readonlyPaths(opts.ReadonlyPaths); err != nil {
+		return err
 	}
 
-	// Mount essential filesystems
-	if err := os.MkdirAll("/proc", 0555); err != nil {
-		return fmt.Errorf("failed to create /proc: %v", err)
+	if err := mountShm(opts.ShmSize); err != nil {
+		return err
 	}
-	if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
-		// Ignore if already mounted
-		if err != syscall.EBUSY {
-			return fmt.Errorf("mount /proc failed: %v", err)
+	if err := mountTmpfs(tmpfsMounts(opts)); err != nil {
+		return err
+	}
+
+	if opts.ReadOnly {
+		// A remount replaces the flags, keep nosuid
+		flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+		if opts.NoSuid {
+			flags |= syscall.MS_NOSUID
+		}
+		if err := syscall.Mount("", "/", "", flags, ""); err != nil {
+			return fmt.Errorf("remount / read-only failed: %v", err)
 		}
 	}
 
-	if err := os.MkdirAll("/sys", 0555); err != nil {
-		return fmt.Errorf("failed to create /sys: %v", err)
+	return nil
+}
+
+// mountRootlessOverlay mounts the overlay of a rootless container, which
+// only works from inside its user namespace
+func mountRootlessOverlay(target string, opts MountOptions) error {
+	if opts.UpperDir == "" {
+		return nil
+	}
+	return rootfs.MountOverlay(opts.LowerDirs, opts.UpperDir, opts.WorkDir, target)
+}
+
+// tmpfsMounts returns the requested tmpfs mounts plus, for a read-only
+// root with ReadOnlyTmpfs, writable /tmp and /run unless already requested
+func tmpfsMounts(opts MountOptions) []Tmpfs {
+	mounts := opts.Tmpfs
+	if !opts.ReadOnly || !opts.ReadOnlyTmpfs {
+		return mounts
+	}
+
+	requested := map[string]bool{}
+	for _, t := range opts.Tmpfs {
+		requested[t.Destination] = true
 	}
-	if err := syscall.Mount("sysfs", "/sys", "sysfs", 0, ""); err != nil {
-		// Ignore if already mounted
-		if err != syscall.EBUSY {
-			return fmt.Errorf("mount /sys failed: %v", err)
+	defaults := []Tmpfs{
+		{Destination: "/tmp", Options: []string{"exec", "mode=1777"}},
+		{Destination: "/run", Options: []string{"exec", "mode=755"}},
+	}
+	for _, d := range defaults {
+		if !requested[d.Destination] {
+			mounts = append(mounts, d)
 		}
 	}
+	return mounts
+}
+
+// mountKernelFS mounts proc, a read-only sysfs unless privileged and the
+// cgroup2 hierarchy in the rootfs. Must run before pivot_root.
+func mountKernelFS(rootfsPath string, privileged bool) error {
+	sysFlags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV)
+	if !privileged {
+		sysFlags |= syscall.MS_RDONLY
+	}
+	mounts := []struct {
+		source, target, fstype string
+		flags                  uintptr
+	}{
+		{"proc", "/proc", "proc", 0},
+		{"sysfs", "/sys", "sysfs", sysFlags},
+		// Inside the cgroup namespace this shows only the container's cgroup
+		{"cgroup2", "/sys/fs/cgroup", "cgroup2", sysFlags},
+	}
+
+	for _, m := range mounts {
+		target, err := rootfs.SecureJoin(rootfsPath, m.target)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0555); err != nil {
+			return fmt.Errorf("failed to create %s: %v", m.target, err)
+		}
+		if err := syscall.Mount(m.source, target, m.fstype, m.flags, ""); err != nil {
+			return fmt.Errorf("mount %s failed: %v", m.target, err)
+		}
+	}
+	return nil
+}
 
-	if err := os.MkdirAll("/dev", 0755); err != nil {
+// setupDev mounts a tmpfs on the rootfs' /dev and fills it. Must run
+// before pivot_root.
+func setupDev(rootfsPath string, opts MountOptions) error {
+	dev, err := rootfs.SecureJoin(rootfsPath, "/dev")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dev, 0755); err != nil {
 		return fmt.Errorf("failed to create /dev: %v", err)
 	}
-	if err := syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755"); err != nil {
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755"); err != nil {
 		return fmt.Errorf("mount /dev failed: %v", err)
 	}
 
 	// Create essential device nodes in /dev
-	if err := createDeviceNodes(); err != nil {
+	if err := createDeviceNodes(dev, opts.UserNS); err != nil {
 		return fmt.Errorf("failed to create device nodes: %v", err)
 	}
+	return createDevices(rootfsPath, opts.Devices, opts.UserNS)
+}
 
-	return nil
+// bindDevice bind mounts the host device node hostPath onto path, for
+// user namespaces where mknod is not allowed
+func bindDevice(hostPath, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return syscall.Mount(hostPath, path, "", syscall.MS_BIND, "")
 }
 
-func createDeviceNodes() error {
+func createDeviceNodes(dev string, userns bool) error {
 	// Device nodes to create: name -> (type, major, minor, mode)
 	devices := []struct {
 		name  string
@@ -111,37 +265,48 @@ func createDeviceNodes() error {
 		{"console", syscall.S_IFCHR | 0600, 5, 1},
 	}
 
-	for _, dev := range devices {
-		path := filepath.Join("/dev", dev.name)
-		devNum := int(unix.Mkdev(dev.major, dev.minor))
+	for _, d := range devices {
+		path := filepath.Join(dev, d.name)
+		if userns {
+			if err := bindDevice(filepath.Join("/dev", d.name), path); err != nil {
+				return fmt.Errorf("bind %s: %v", d.name, err)
+			}
+			continue
+		}
+		devNum := int(unix.Mkdev(d.major, d.minor))
 
-		if err := syscall.Mknod(path, dev.mode, devNum); err != nil {
+		if err := syscall.Mknod(path, d.mode, devNum); err != nil {
 			// Ignore if already exists
 			if !os.IsExist(err) {
-				return fmt.Errorf("mknod %s: %v", dev.name, err)
+				return fmt.Errorf("mknod %s: %v", d.name, err)
 			}
 		}
+		// mknod applies the umask, users other than root need these modes
+		if err := syscall.Chmod(path, d.mode&07777); err != nil {
+			return fmt.Errorf("chmod %s: %v", d.name, err)
+		}
 	}
 
 	// Create /dev/pts directory for pseudo-terminals
-	if err := os.MkdirAll("/dev/pts", 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(dev, "pts"), 0755); err != nil {
 		return fmt.Errorf("failed to create /dev/pts: %v", err)
 	}
 
 	// Create /dev/shm for shared memory
-	if err := os.MkdirAll("/dev/shm", 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(dev, "shm"), 0755); err != nil {
 		return fmt.Errorf("failed to create /dev/shm: %v", err)
 	}
 
 	// Create standard file descriptors symlinks
 	symlinks := map[string]string{
-		"/dev/fd":     "/proc/self/fd",
-		"/dev/stdin":  "/proc/self/fd/0",
-		"/dev/stdout": "/proc/self/fd/1",
-		"/dev/stderr": "/proc/self/fd/2",
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
 	}
 
-	for link, target := range symlinks {
+	for name, target := range symlinks {
+		link := filepath.Join(dev, name)
 		os.Remove(link) // Remove if exists
 		if err := os.Symlink(target, link); err != nil {
 			// Non-critical, just log
@@ -151,19 +316,36 @@ func createDeviceNodes() error {
 
 	return nil
 }
-func setupDNS() error {
-	// Create /etc directory if it doesn't exist
-	if err := os.MkdirAll("/etc", 0755); err != nil {
-		return fmt.Errorf("failed to create /etc: %v", err)
-	}
 
+// setupDNS writes resolv.conf next to the rootfs and bind mounts it onto
+// /etc/resolv.conf inside it. Must run before pivot_root.
+func setupDNS(rootfsPath string) error {
 	// Write resolv.conf with Google's DNS servers
 	resolvConfContent := "nameserver 8.8.8.8\nnameserver 8.8.4.4\n"
 
-	if err := os.WriteFile("/etc/resolv.conf", []byte(resolvConfContent), 0644); err != nil {
+	source := filepath.Join(filepath.Dir(rootfsPath), "resolv.conf")
+	if err := os.WriteFile(source, []byte(resolvConfContent), 0644); err != nil {
 		return fmt.Errorf("failed to write resolv.conf: %v", err)
 	}
 
+	// Resolve symlinks inside the rootfs, e.g. to a systemd stub
+	target, err := rootfs.SecureJoin(rootfsPath, "/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create /etc: %v", err)
+	}
+	if fi, err := os.Stat(target); err != nil || !fi.Mode().IsRegular() {
+		os.Remove(target)
+		if err := os.WriteFile(target, nil, 0644); err != nil {
+			return fmt.Errorf("failed to create resolv.conf mount point: %v", err)
+		}
+	}
+
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount resolv.conf: %v", err)
+	}
 	return nil
 }
 func MountEssentialFilesystems() error {
@@ -0,0 +1,98 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// DefaultMaskedPaths are hidden from containers, as in OCI runtimes
+var DefaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/devices/virtual/powercap",
+	"/sys/firmware",
+}
+
+// DefaultReadonlyPaths are visible to containers but cannot be written
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// SecurityPaths returns the masked and read-only paths for a container:
+// the defaults plus mask, minus unmask ("ALL" unmasks everything)
+func SecurityPaths(mask, unmask []string) ([]string, []string) {
+	masked := append(append([]string{}, DefaultMaskedPaths...), mask...)
+	readonly := append([]string{}, DefaultReadonlyPaths...)
+
+	for _, path := range unmask {
+		if path == "ALL" {
+			return mask, nil
+		}
+		masked = removePath(masked, path)
+		readonly = removePath(readonly, path)
+	}
+	return masked, readonly
+}
+
+func removePath(paths []string, path string) []string {
+	var kept []string
+	for _, p := range paths {
+		if p != path {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// maskPaths hides each path: files are covered by /dev/null and
+// directories by an empty read-only tmpfs. Runs after pivot_root.
+func maskPaths(paths []string) error {
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("mask %s: %v", path, err)
+		}
+
+		if fi.IsDir() {
+			err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "")
+		} else {
+			err = syscall.Mount("/dev/null", path, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("mask %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// readonlyPaths bind mounts each path over itself read-only. Runs after
+// pivot_root.
+func readonlyPaths(paths []string) error {
+	for _, path := range paths {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s read-only: %v", path, err)
+		}
+		if err := syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("remount %s read-only: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package container
+
+import "gocount/internal/seccomp"
+
+// Unconfined turns seccomp off when given as the profile
+const Unconfined = "unconfined"
+
+// SeccompFilter returns the profile the container process runs under, or
+// nil when it is unconfined
+func (c *Container) SeccompFilter() *seccomp.Profile {
+	if c.Privileged || c.SeccompProfile == Unconfined {
+		return nil
+	}
+	p := seccomp.DefaultProfile
+	if c.SeccompRules != nil {
+		p = c.SeccompRules
+	}
+	if c.SeccompLog {
+		p = p.LogOnly()
+	}
+	return p
+}
@@ -0,0 +1,124 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gocount/internal/rootfs"
+)
+
+// DefaultShmSize is the size of /dev/shm unless --shm-size says otherwise
+const DefaultShmSize = 64 << 20
+
+// Tmpfs is a tmpfs mounted inside the container
+type Tmpfs struct {
+	Destination string
+	Options     []string `json:",omitempty"`
+}
+
+// Mount flags accepted in tmpfs options, and whether each sets or clears its flag
+var tmpfsFlags = map[string]struct {
+	set   bool
+	value uintptr
+}{
+	"ro":     {true, syscall.MS_RDONLY},
+	"rw":     {false, syscall.MS_RDONLY},
+	"noexec": {true, syscall.MS_NOEXEC},
+	"exec":   {false, syscall.MS_NOEXEC},
+	"nosuid": {true, syscall.MS_NOSUID},
+	"suid":   {false, syscall.MS_NOSUID},
+	"nodev":  {true, syscall.MS_NODEV},
+	"dev":    {false, syscall.MS_NODEV},
+}
+
+// ParseTmpfs parses "/path[:opts]", where opts is a comma separated list of
+// size=, mode=, uid=, gid=, nr_inodes= and mount flags such as noexec
+func ParseTmpfs(spec string) (Tmpfs, error) {
+	dest, opts, _ := strings.Cut(spec, ":")
+	t := Tmpfs{Destination: filepath.Clean(dest)}
+	if !filepath.IsAbs(dest) || t.Destination == "/" {
+		return Tmpfs{}, fmt.Errorf("invalid tmpfs %q: path must be absolute and not /", spec)
+	}
+	if opts == "" {
+		return t, nil
+	}
+
+	for _, opt := range strings.Split(opts, ",") {
+		key, value, hasValue := strings.Cut(opt, "=")
+		var err error
+		switch key {
+		case "size":
+			if !strings.HasSuffix(value, "%") {
+				_, err = rootfs.ParseSize(value)
+			}
+		case "mode":
+			_, err = strconv.ParseUint(value, 8, 32)
+		case "uid", "gid", "nr_inodes":
+			_, err = strconv.ParseUint(value, 10, 32)
+		default:
+			if _, ok := tmpfsFlags[key]; !ok || hasValue {
+				err = fmt.Errorf("unknown option")
+			}
+		}
+		if err != nil {
+			return Tmpfs{}, fmt.Errorf("invalid tmpfs %q: option %q: %v", spec, opt, err)
+		}
+		t.Options = append(t.Options, opt)
+	}
+	return t, nil
+}
+
+// mountArgs returns the mount flags and data for t. Like Docker, tmpfs
+// mounts are noexec, nosuid and nodev unless the options say otherwise.
+func (t Tmpfs) mountArgs() (uintptr, string) {
+	flags := uintptr(syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV)
+	var data []string
+	for _, opt := range t.Options {
+		if f, ok := tmpfsFlags[opt]; ok {
+			if f.set {
+				flags |= f.value
+			} else {
+				flags &^= f.value
+			}
+			continue
+		}
+		// size accepts k/m/g suffixes in either case; tmpfs wants lower case
+		if value, ok := strings.CutPrefix(opt, "size="); ok {
+			opt = "size=" + strings.ToLower(strings.TrimSuffix(strings.ToUpper(value), "B"))
+		}
+		data = append(data, opt)
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// mountTmpfs mounts each tmpfs. Runs after pivot_root, so paths resolve
+// inside the container.
+func mountTmpfs(mounts []Tmpfs) error {
+	for _, t := range mounts {
+		if err := os.MkdirAll(t.Destination, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %v", t.Destination, err)
+		}
+		flags, data := t.mountArgs()
+		if err := syscall.Mount("tmpfs", t.Destination, "tmpfs", flags, data); err != nil {
+			return fmt.Errorf("mount tmpfs on %s failed: %v", t.Destination, err)
+		}
+	}
+	return nil
+}
+
+// mountShm gives /dev/shm its own tmpfs of size bytes
+func mountShm(size int64) error {
+	if size <= 0 {
+		size = DefaultShmSize
+	}
+	flags := uintptr(syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV)
+	data := fmt.Sprintf("mode=1777,size=%d", size)
+	if err := syscall.Mount("shm", "/dev/shm", "tmpfs", flags, data); err != nil {
+		return fmt.Errorf("mount /dev/shm failed: %v", err)
+	}
+	return nil
+}
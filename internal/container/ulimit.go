@@ -0,0 +1,148 @@
+package container
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// rlimits maps ulimit names to resources and their rows in /proc/<pid>/limits
+var rlimits = map[string]struct {
+	resource int
+	label    string
+}{
+	"as":         {unix.RLIMIT_AS, "Max address space"},
+	"core":       {unix.RLIMIT_CORE, "Max core file size"},
+	"cpu":        {unix.RLIMIT_CPU, "Max cpu time"},
+	"data":       {unix.RLIMIT_DATA, "Max data size"},
+	"fsize":      {unix.RLIMIT_FSIZE, "Max file size"},
+	"locks":      {unix.RLIMIT_LOCKS, "Max file locks"},
+	"memlock":    {unix.RLIMIT_MEMLOCK, "Max locked memory"},
+	"msgqueue":   {unix.RLIMIT_MSGQUEUE, "Max msgqueue size"},
+	"nice":       {unix.RLIMIT_NICE, "Max nice priority"},
+	"nofile":     {unix.RLIMIT_NOFILE, "Max open files"},
+	"nproc":      {unix.RLIMIT_NPROC, "Max processes"},
+	"rss":        {unix.RLIMIT_RSS, "Max resident set"},
+	"rtprio":     {unix.RLIMIT_RTPRIO, "Max realtime priority"},
+	"rttime":     {unix.RLIMIT_RTTIME, "Max realtime timeout"},
+	"sigpending": {unix.RLIMIT_SIGPENDING, "Max pending signals"},
+	"stack":      {unix.RLIMIT_STACK, "Max stack size"},
+}
+
+// Unlimited is the value of a limit without a bound
+const Unlimited = math.MaxUint64
+
+// Ulimit is a resource limit of the container process
+type Ulimit struct {
+	Name string
+	Soft uint64
+	Hard uint64
+}
+
+func (u Ulimit) String() string {
+	return formatLimit(u.Soft) + ":" + formatLimit(u.Hard)
+}
+
+func formatLimit(v uint64) string {
+	if v == Unlimited {
+		return "unlimited"
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+func parseLimit(s string) (uint64, error) {
+	if s == "unlimited" || s == "-1" {
+		return Unlimited, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// ParseUlimits parses "name=soft[:hard],..." such as
+// "nofile=1024:4096,core=0". The hard limit defaults to the soft one.
+func ParseUlimits(spec string) ([]Ulimit, error) {
+	var ulimits []Ulimit
+	for _, item := range strings.Split(spec, ",") {
+		name, values, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid ulimit %q: expected name=soft[:hard]", item)
+		}
+		if _, ok := rlimits[name]; !ok {
+			return nil, fmt.Errorf("invalid ulimit %q: unknown resource %q", item, name)
+		}
+		softPart, hardPart, hasHard := strings.Cut(values, ":")
+		if !hasHard {
+			hardPart = softPart
+		}
+		soft, err := parseLimit(softPart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ulimit %q: %q is not a limit", item, softPart)
+		}
+		hard, err := parseLimit(hardPart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ulimit %q: %q is not a limit", item, hardPart)
+		}
+		if soft > hard {
+			return nil, fmt.Errorf("invalid ulimit %q: soft limit is above the hard limit", item)
+		}
+		ulimits = append(ulimits, Ulimit{Name: name, Soft: soft, Hard: hard})
+	}
+	return ulimits, nil
+}
+
+// MergeUlimits returns base with the limits in overrides replacing those
+// of the same resource
+func MergeUlimits(base, overrides []Ulimit) []Ulimit {
+	merged := append([]Ulimit{}, base...)
+	for _, o := range overrides {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == o.Name {
+				merged[i], replaced = o, true
+			}
+		}
+		if !replaced {
+			merged = append(merged, o)
+		}
+	}
+	return merged
+}
+
+// WithinCurrent lowers ulimits to what the calling process could set
+// without CAP_SYS_RESOURCE, its own hard limits
+func WithinCurrent(ulimits []Ulimit) []Ulimit {
+	var out []Ulimit
+	for _, u := range ulimits {
+		var cur syscall.Rlimit
+		if r, ok := rlimits[u.Name]; ok && syscall.Getrlimit(r.resource, &cur) == nil {
+			u.Hard = min(u.Hard, cur.Max)
+			u.Soft = min(u.Soft, u.Hard)
+		}
+		out = append(out, u)
+	}
+	return out
+}
+
+// ApplyUlimits sets the limits on the calling process. Raising a hard
+// limit needs CAP_SYS_RESOURCE, so call it before dropping capabilities.
+func ApplyUlimits(ulimits []Ulimit) error {
+	for _, u := range ulimits {
+		r, ok := rlimits[u.Name]
+		if !ok {
+			return fmt.Errorf("unknown ulimit %q", u.Name)
+		}
+		// syscall.Setrlimit also stops Go restoring its own nofile on exec
+		if err := syscall.Setrlimit(r.resource, &syscall.Rlimit{Cur: u.Soft, Max: u.Hard}); err != nil {
+			return fmt.Errorf("cannot set ulimit %s=%s: %v", u.Name, u, err)
+		}
+	}
+	return nil
+}
+
+// UlimitLabel returns the row of /proc/<pid>/limits for a ulimit name
+func UlimitLabel(name string) string {
+	return rlimits[name].label
+}
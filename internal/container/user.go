@@ -0,0 +1,167 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExecUser is who the container command runs as
+type ExecUser struct {
+	Name   string
+	UID    int
+	GID    int
+	Groups []int
+	Home   string
+}
+
+// readEntries returns the colon separated fields of each line of an
+// /etc/passwd or /etc/group style file. A missing file has no entries.
+func readEntries(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
+
+// LookupUser resolves "user[:group]", each a name or a number, against the
+// /etc/passwd and /etc/group of the current root. Numeric ids need no
+// entry; names must have one. The user gets its primary group unless one
+// is given, and the groups that list it as a member.
+func LookupUser(spec string) (ExecUser, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	u := ExecUser{Name: userPart, Home: "/"}
+
+	passwd, err := readEntries("/etc/passwd")
+	if err != nil {
+		return u, fmt.Errorf("cannot read /etc/passwd: %v", err)
+	}
+	uid, numeric := parseID(userPart)
+	found := false
+	for _, e := range passwd {
+		if len(e) < 7 || (e[0] != userPart && (!numeric || e[2] != userPart)) {
+			continue
+		}
+		var ok1, ok2 bool
+		u.UID, ok1 = parseID(e[2])
+		u.GID, ok2 = parseID(e[3])
+		if !ok1 || !ok2 {
+			return u, fmt.Errorf("invalid /etc/passwd entry for %s", e[0])
+		}
+		u.Name, u.Home = e[0], e[5]
+		found = true
+		break
+	}
+	if !found {
+		if !numeric {
+			return u, fmt.Errorf("no user %q in /etc/passwd", userPart)
+		}
+		u.UID = uid
+	}
+
+	group, err := readEntries("/etc/group")
+	if err != nil {
+		return u, fmt.Errorf("cannot read /etc/group: %v", err)
+	}
+	if hasGroup {
+		gid, numeric := parseID(groupPart)
+		found := numeric
+		for _, e := range group {
+			if len(e) >= 3 && e[0] == groupPart {
+				if gid, found = parseID(e[2]); !found {
+					return u, fmt.Errorf("invalid /etc/group entry for %s", e[0])
+				}
+				break
+			}
+		}
+		if !found {
+			return u, fmt.Errorf("no group %q in /etc/group", groupPart)
+		}
+		u.GID = gid
+	}
+
+	u.Groups = []int{u.GID}
+	for _, e := range group {
+		if len(e) < 4 {
+			continue
+		}
+		gid, ok := parseID(e[2])
+		if !ok || gid == u.GID {
+			continue
+		}
+		for _, member := range strings.Split(e[3], ",") {
+			if member == u.Name {
+				u.Groups = append(u.Groups, gid)
+				break
+			}
+		}
+	}
+	return u, nil
+}
+
+// setgroupsDenied reports whether our user namespace forbids setgroups
+func setgroupsDenied() bool {
+	data, err := os.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(data)) == "deny"
+}
+
+// parseID parses a non-negative uid or gid
+func parseID(s string) (int, bool) {
+	id, err := strconv.Atoi(s)
+	return id, err == nil && id >= 0
+}
+
+// SetUser switches the calling thread to u, keeping its capabilities so
+// they can be dropped afterwards
+func SetUser(u ExecUser) error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capget: %v", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("cannot keep capabilities: %v", err)
+	}
+
+	// Groups first: setgroups and setgid need the privileges setuid drops.
+	// Rootless user namespaces deny setgroups, there are no others to use.
+	if !setgroupsDenied() {
+		if err := unix.Setgroups(u.Groups); err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+	}
+	if err := unix.Setgid(u.GID); err != nil {
+		return fmt.Errorf("setgid %d: %v", u.GID, err)
+	}
+	if err := unix.Setuid(u.UID); err != nil {
+		return fmt.Errorf("setuid %d: %v", u.UID, err)
+	}
+
+	// Leaving uid 0 cleared the effective set even with keepcaps
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capset: %v", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("cannot reset keepcaps: %v", err)
+	}
+	return nil
+}
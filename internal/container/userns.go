@@ -0,0 +1,203 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gocount/internal/rootfs"
+)
+
+// IDMap maps Size ids starting at ContainerID to ids starting at HostID
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// ParseIDMap parses "container:host:size"
+func ParseIDMap(spec string) (IDMap, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return IDMap{}, fmt.Errorf("invalid id map %q: expected container:host:size", spec)
+	}
+	var ids [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return IDMap{}, fmt.Errorf("invalid id map %q: %q is not a valid id", spec, p)
+		}
+		ids[i] = n
+	}
+	if ids[2] == 0 {
+		return IDMap{}, fmt.Errorf("invalid id map %q: size must be positive", spec)
+	}
+	return IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}, nil
+}
+
+// SubIDMap maps container root to the current user's first range in a
+// subordinate id file such as /etc/subuid
+func SubIDMap(file string) (IDMap, error) {
+	u, err := user.Current()
+	if err != nil {
+		return IDMap{}, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return IDMap{}, fmt.Errorf("no subordinate ids: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(parts) != 3 || (parts[0] != u.Username && parts[0] != u.Uid) {
+			continue
+		}
+		start, err1 := strconv.Atoi(parts[1])
+		count, err2 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil || count <= 0 {
+			return IDMap{}, fmt.Errorf("invalid entry in %s: %q", file, scanner.Text())
+		}
+		return IDMap{ContainerID: 0, HostID: start, Size: count}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return IDMap{}, err
+	}
+	return IDMap{}, fmt.Errorf("no subordinate ids for %s in %s", u.Username, file)
+}
+
+// hostID returns the host id that id maps to, if any
+func hostID(maps []IDMap, id int) (int, bool) {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// containerID returns the container id that host id maps to. Ids outside
+// the maps are returned as they are, like ChownRootfs leaves them alone.
+func containerID(maps []IDMap, id int) int {
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID
+		}
+	}
+	return id
+}
+
+// sysProcIDMaps converts maps for syscall.SysProcAttr
+func sysProcIDMaps(maps []IDMap) []syscall.SysProcIDMap {
+	var out []syscall.SysProcIDMap
+	for _, m := range maps {
+		out = append(out, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	return out
+}
+
+// UserNS reports whether c runs in its own user namespace
+func (c *Container) UserNS() bool {
+	return len(c.UIDMap) > 0
+}
+
+// ContainerIDs maps the owners of files in the rootfs back to the ids the
+// container sees, undoing ChownRootfs. Nil without a user namespace.
+func (c *Container) ContainerIDs() rootfs.IDMapper {
+	if !c.UserNS() {
+		return nil
+	}
+	return func(uid, gid int) (int, int) {
+		return containerID(c.UIDMap, uid), containerID(c.GIDMap, gid)
+	}
+}
+
+// RootlessIDMaps maps container root to the current user and group, the
+// only mapping a regular user may set up without setuid helpers
+func RootlessIDMaps() ([]IDMap, []IDMap) {
+	return []IDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}},
+		[]IDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+}
+
+// SetUserNS configures the child process to start in a new user namespace
+// using c's id maps, running as container root. The maps are written by
+// the parent before the child is released.
+func (c *Container) SetUserNS(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	attr.UidMappings = sysProcIDMaps(c.UIDMap)
+	attr.GidMappings = sysProcIDMaps(c.GIDMap)
+	// Without root, gid_map can only be written once setgroups is denied
+	attr.GidMappingsEnableSetgroups = !c.Rootless
+	attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: c.Rootless}
+}
+
+// ChownRootfs shifts the owner of every file in the rootfs into the user
+// namespace, so container root owns what host root owned. On an overlay
+// this copies files up. The directory holding the rootfs is given to
+// container root too, for files such as resolv.conf written next to it.
+func (c *Container) ChownRootfs() error {
+	uid, ok := hostID(c.UIDMap, 0)
+	if !ok {
+		return fmt.Errorf("uid map does not include root")
+	}
+	gid, ok := hostID(c.GIDMap, 0)
+	if !ok {
+		return fmt.Errorf("gid map does not include root")
+	}
+	if err := os.Chown(filepath.Dir(c.RootFs), uid, gid); err != nil {
+		return err
+	}
+
+	// Collect owners first: after a chown, a hardlink to the same file
+	// would show the shifted owner
+	type entry struct {
+		path     string
+		uid, gid int
+		mode     fs.FileMode
+	}
+	var entries []entry
+	err := filepath.WalkDir(c.RootFs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		entries = append(entries, entry{path, int(st.Uid), int(st.Gid), fi.Mode()})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan rootfs: %v", err)
+	}
+
+	for _, e := range entries {
+		// Ids outside the map are left alone and show up as nobody
+		uid, uidOK := hostID(c.UIDMap, e.uid)
+		gid, gidOK := hostID(c.GIDMap, e.gid)
+		if !uidOK {
+			uid = -1
+		}
+		if !gidOK {
+			gid = -1
+		}
+		if err := os.Lchown(e.path, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %s: %v", e.path, err)
+		}
+		// chown clears the setuid and setgid bits
+		if e.mode&(fs.ModeSetuid|fs.ModeSetgid) != 0 && e.mode&fs.ModeSymlink == 0 {
+			if err := os.Chmod(e.path, e.mode); err != nil {
+				return fmt.Errorf("failed to chmod %s: %v", e.path, err)
+			}
+		}
+	}
+	return nil
+}
@@ -1,7 +1,11 @@
 package container
 
-import "os"
+import (
+	"os"
+
+	"gocount/internal/paths"
+)
 
 func EnsureContainerDir() error {
-    return os.MkdirAll("/tmp/gocount", 0755)
+    return os.MkdirAll(paths.Root, 0755)
 }
@@ -0,0 +1,190 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gocount/internal/rootfs"
+	"gocount/internal/volume"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mount is a host path or named volume bind mounted into the container
+type Mount struct {
+	Source      string
+	Destination string
+	Volume      string `json:",omitempty"` // name of the volume at Source
+	ReadOnly    bool   `json:",omitempty"`
+	Propagation string `json:",omitempty"` // default rprivate
+}
+
+// Mount propagation modes accepted in volume options
+var propagationFlags = map[string]uintptr{
+	"private":  syscall.MS_PRIVATE,
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+	"shared":   syscall.MS_SHARED,
+	"rshared":  syscall.MS_SHARED | syscall.MS_REC,
+}
+
+// ParseVolume parses "host:container[:opts]", where opts is a comma
+// separated list of ro, rw and a propagation mode. A host part that is not
+// a path names a volume; its Source is left for the caller to resolve.
+func ParseVolume(spec string) (Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Mount{}, fmt.Errorf("invalid volume %q: expected host:container[:opts]", spec)
+	}
+
+	m := Mount{Destination: filepath.Clean(parts[1])}
+	if !filepath.IsAbs(m.Destination) || m.Destination == "/" {
+		return Mount{}, fmt.Errorf("invalid volume %q: container path must be absolute and not /", spec)
+	}
+	switch {
+	case filepath.IsAbs(parts[0]):
+		m.Source = filepath.Clean(parts[0])
+		if _, err := os.Stat(m.Source); err != nil {
+			return Mount{}, fmt.Errorf("invalid volume %q: %v", spec, err)
+		}
+	case volume.ValidName(parts[0]):
+		m.Volume = parts[0]
+	default:
+		return Mount{}, fmt.Errorf("invalid volume %q: host path must be absolute or a volume name", spec)
+	}
+
+	if len(parts) == 3 {
+		for _, opt := range strings.Split(parts[2], ",") {
+			switch {
+			case opt == "ro":
+				m.ReadOnly = true
+			case opt == "rw":
+				m.ReadOnly = false
+			case propagationFlags[opt] != 0:
+				m.Propagation = opt
+			default:
+				return Mount{}, fmt.Errorf("invalid volume %q: unknown option %q", spec, opt)
+			}
+		}
+	}
+	return m, nil
+}
+
+// mountVolumes bind mounts each volume into rootfsPath. Destinations are
+// resolved inside the rootfs, so symlinks in the image cannot redirect a
+// mount onto the host. Must run before pivot_root.
+func mountVolumes(rootfsPath string, mounts []Mount) error {
+	for _, m := range mounts {
+		target, err := rootfs.SecureJoin(rootfsPath, m.Destination)
+		if err != nil {
+			return fmt.Errorf("volume %s: %v", m.Destination, err)
+		}
+		if err := createMountpoint(m.Source, target); err != nil {
+			return fmt.Errorf("volume %s: %v", m.Destination, err)
+		}
+
+		if err := syscall.Mount(m.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind mount %s on %s: %v", m.Source, m.Destination, err)
+		}
+		if m.ReadOnly {
+			if err := remountReadOnly(target); err != nil {
+				return fmt.Errorf("remount %s read-only: %v", m.Destination, err)
+			}
+		}
+
+		propagation := m.Propagation
+		if propagation == "" {
+			propagation = "rprivate"
+		}
+		if err := syscall.Mount("", target, "", propagationFlags[propagation], ""); err != nil {
+			return fmt.Errorf("set %s propagation on %s: %v", propagation, m.Destination, err)
+		}
+	}
+	return nil
+}
+
+// remountReadOnly makes target and every mount below it read-only, so a
+// recursive bind cannot leave writable submounts behind
+func remountReadOnly(target string) error {
+	attr := unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}
+	err := unix.MountSetattr(unix.AT_FDCWD, target, unix.AT_RECURSIVE, &attr)
+	if !errors.Is(err, unix.ENOSYS) {
+		return err
+	}
+
+	// Before Linux 5.12 each mount is remounted on its own
+	mountpoints, err := submounts(target)
+	if err != nil {
+		return err
+	}
+	for _, mp := range mountpoints {
+		var st unix.Statfs_t
+		if err := unix.Statfs(mp, &st); err != nil {
+			return err
+		}
+		// A remount replaces the flags. The ST_ ones match MS_ and some may
+		// be locked by a user namespace, so keep them.
+		keep := st.Flags & (unix.ST_NOSUID | unix.ST_NODEV | unix.ST_NOEXEC |
+			unix.ST_NOATIME | unix.ST_NODIRATIME | unix.ST_RELATIME)
+		flags := uintptr(syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY) | uintptr(keep)
+		if err := syscall.Mount("", mp, "", flags, ""); err != nil {
+			return fmt.Errorf("remount %s: %v", mp, err)
+		}
+	}
+	return nil
+}
+
+// submounts returns target and the mount points below it, parents first
+func submounts(target string) ([]string, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	mountpoints := []string{target}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		// Spaces and the like are octal escaped
+		mp := fields[4]
+		if strings.Contains(mp, "\\") {
+			if unquoted, err := strconv.Unquote(`"` + mp + `"`); err == nil {
+				mp = unquoted
+			}
+		}
+		if strings.HasPrefix(mp, target+"/") {
+			mountpoints = append(mountpoints, mp)
+		}
+	}
+	sort.Slice(mountpoints, func(i, j int) bool { return len(mountpoints[i]) < len(mountpoints[j]) })
+	return mountpoints, nil
+}
+
+// createMountpoint creates target as a directory or an empty file,
+// matching the type of source
+func createMountpoint(source, target string) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
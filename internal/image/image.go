@@ -0,0 +1,365 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gocount/internal/paths"
+	"gocount/internal/rootfs"
+)
+
+// Root is where images and their layers are stored
+var Root = filepath.Join(paths.Root, "images")
+
+// Config holds the defaults a container started from the image inherits
+type Config struct {
+	Env        []string `json:",omitempty"`
+	Cmd        []string `json:",omitempty"`
+	Entrypoint []string `json:",omitempty"`
+	WorkingDir string   `json:",omitempty"`
+}
+
+// Image is a named stack of filesystem layers plus run configuration
+type Image struct {
+	Name    string
+	ID      string
+	Parent  string   `json:",omitempty"`
+	Layers  []string // layer digests, base first
+	Created time.Time
+	Author  string `json:",omitempty"`
+	Comment string `json:",omitempty"`
+	Config  Config
+}
+
+// LayerDir returns the directory holding the extracted layer with digest
+func LayerDir(digest string) string {
+	return filepath.Join(Root, "layers", digest)
+}
+
+// LowerDirs returns the layer directories topmost first, for overlayfs
+func (img *Image) LowerDirs() []string {
+	dirs := make([]string, 0, len(img.Layers))
+	for i := len(img.Layers) - 1; i >= 0; i-- {
+		dirs = append(dirs, LayerDir(img.Layers[i]))
+	}
+	return dirs
+}
+
+// ParseRef normalises "name[:tag]", defaulting the tag to "latest"
+func ParseRef(ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("empty image reference")
+	}
+	name, tag := ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	if name == "" || tag == "" {
+		return "", fmt.Errorf("invalid image reference: %s", ref)
+	}
+	for _, r := range name + tag {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("._-/", r)) {
+			return "", fmt.Errorf("invalid image reference: %s", ref)
+		}
+	}
+	return name + ":" + tag, nil
+}
+
+func metadataPath(ref string) string {
+	return filepath.Join(Root, url.PathEscape(ref)+".json")
+}
+
+// Save writes image metadata, computing its ID from layers and config
+func Save(img *Image) error {
+	if err := os.MkdirAll(Root, 0755); err != nil {
+		return fmt.Errorf("failed to create image store: %v", err)
+	}
+
+	content, _ := json.Marshal(struct {
+		Parent string
+		Layers []string
+		Config Config
+	}{img.Parent, img.Layers, img.Config})
+	sum := sha256.Sum256(content)
+	img.ID = hex.EncodeToString(sum[:])
+
+	data, err := json.MarshalIndent(img, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metadataPath(img.Name), data, 0644)
+}
+
+// Get loads the image with the given reference
+func Get(ref string) (*Image, error) {
+	ref, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(metadataPath(ref))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("image not found: %s", ref)
+		}
+		return nil, err
+	}
+	var img Image
+	if err := json.Unmarshal(data, &img); err != nil {
+		return nil, fmt.Errorf("could not parse image %s: %v", ref, err)
+	}
+	return &img, nil
+}
+
+// List returns all images sorted by name
+func List() ([]*Image, error) {
+	var images []*Image
+	files, _ := os.ReadDir(Root)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		ref, err := url.PathUnescape(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		img, err := Get(ref)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			continue
+		}
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+// AddLayer extracts a (possibly compressed) tar stream into the layer store
+// and returns its digest. Identical layers are stored once.
+func AddLayer(r io.Reader) (string, error) {
+	layers := filepath.Join(Root, "layers")
+	if err := os.MkdirAll(layers, 0755); err != nil {
+		return "", fmt.Errorf("failed to create layer store: %v", err)
+	}
+	staging, err := os.MkdirTemp(layers, ".staging-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	if err := os.Chmod(staging, 0755); err != nil {
+		return "", err
+	}
+
+	digest, err := rootfs.ExtractLayer(r, staging)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract layer: %v", err)
+	}
+
+	if _, err := os.Stat(LayerDir(digest)); err == nil {
+		return digest, nil
+	}
+	if err := os.Rename(staging, LayerDir(digest)); err != nil {
+		return "", fmt.Errorf("failed to store layer: %v", err)
+	}
+	return digest, nil
+}
+
+// Import creates a single-layer image named ref from a filesystem tarball
+func Import(r io.Reader, ref string) (*Image, error) {
+	ref, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := AddLayer(r)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Name:    ref,
+		Layers:  []string{digest},
+		Created: time.Now(),
+		Comment: "imported",
+	}
+	if err := Save(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// FromTrees returns an unnamed, unsaved image whose layers are the trees in
+// dirs (topmost first, as in LowerDirs), such as the cached rootfs under a
+// container that was not started from an image. Each tree is added to the
+// layer store on first use only.
+func FromTrees(dirs []string) (*Image, error) {
+	img := &Image{}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		digest, err := treeLayer(dirs[i])
+		if err != nil {
+			return nil, fmt.Errorf("cannot import %s: %v", dirs[i], err)
+		}
+		img.Layers = append(img.Layers, digest)
+	}
+	return img, nil
+}
+
+// treeLayer returns the digest of the layer holding dir, adding it to the
+// layer store unless an earlier call already did. Trees are never changed
+// once extracted, so the digest is remembered by path.
+func treeLayer(dir string) (string, error) {
+	key := sha256.Sum256([]byte(filepath.Clean(dir)))
+	memo := filepath.Join(Root, "trees", hex.EncodeToString(key[:]))
+	if data, err := os.ReadFile(memo); err == nil {
+		digest := strings.TrimSpace(string(data))
+		if _, err := os.Stat(LayerDir(digest)); err == nil {
+			return digest, nil
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rootfs.WriteTar(pw, dir))
+	}()
+	digest, err := AddLayer(pr)
+	pr.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(memo), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(memo, []byte(digest+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// ApplyChange applies a Dockerfile-style instruction (ENV, CMD, ENTRYPOINT
+// or WORKDIR) to the config
+func (c *Config) ApplyChange(change string) error {
+	keyword, value, _ := strings.Cut(strings.TrimSpace(change), " ")
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fmt.Errorf("invalid change %q: missing value", change)
+	}
+
+	switch strings.ToUpper(keyword) {
+	case "ENV":
+		key, val, ok := strings.Cut(value, "=")
+		if !ok {
+			// Legacy "ENV KEY value" form
+			key, val, _ = strings.Cut(value, " ")
+			val = strings.TrimSpace(val)
+		}
+		c.Env = setEnv(c.Env, key, val)
+	case "CMD":
+		cmd, err := ParseCommand(value)
+		if err != nil {
+			return err
+		}
+		c.Cmd = cmd
+	case "ENTRYPOINT":
+		cmd, err := ParseCommand(value)
+		if err != nil {
+			return err
+		}
+		c.Entrypoint = cmd
+	case "WORKDIR":
+		if !filepath.IsAbs(value) {
+			value = filepath.Join("/", c.WorkingDir, value)
+		}
+		c.WorkingDir = value
+	default:
+		return fmt.Errorf("invalid change %q: unsupported instruction %s", change, keyword)
+	}
+	return nil
+}
+
+// Command returns the entrypoint and command a container runs by default
+func (c *Config) Command() []string {
+	return append(append([]string{}, c.Entrypoint...), c.Cmd...)
+}
+
+// ParseCommand accepts the JSON form (["/bin/sh", "-c", "..."]) or the shell
+// form, which is wrapped in /bin/sh -c
+func ParseCommand(value string) ([]string, error) {
+	if strings.HasPrefix(value, "[") {
+		var cmd []string
+		if err := json.Unmarshal([]byte(value), &cmd); err != nil {
+			return nil, fmt.Errorf("invalid command %s: %v", value, err)
+		}
+		return cmd, nil
+	}
+	return []string{"/bin/sh", "-c", value}, nil
+}
+
+// setEnv sets key=val in env, replacing an existing entry
+func setEnv(env []string, key, val string) []string {
+	for i, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			env[i] = key + "=" + val
+			return env
+		}
+	}
+	return append(env, key+"="+val)
+}
+
+// CommitOptions carry the metadata recorded for a committed image
+type CommitOptions struct {
+	Author  string
+	Message string
+	// Dockerfile-style config changes, see Config.ApplyChange
+	Changes []string
+}
+
+// Commit creates image ref by adding the layer read from r on top of base,
+// which may be nil for a standalone image
+func Commit(base *Image, r io.Reader, ref string, opts CommitOptions) (*Image, error) {
+	ref, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Name:    ref,
+		Created: time.Now(),
+		Author:  opts.Author,
+		Comment: opts.Message,
+	}
+	if base != nil {
+		img.Parent = base.ID
+		img.Layers = append(img.Layers, base.Layers...)
+		img.Config = Config{
+			Env:        append([]string{}, base.Config.Env...),
+			Cmd:        base.Config.Cmd,
+			Entrypoint: base.Config.Entrypoint,
+			WorkingDir: base.Config.WorkingDir,
+		}
+	}
+	for _, change := range opts.Changes {
+		if err := img.Config.ApplyChange(change); err != nil {
+			return nil, err
+		}
+	}
+
+	digest, err := AddLayer(r)
+	if err != nil {
+		return nil, err
+	}
+	img.Layers = append(img.Layers, digest)
+
+	if err := Save(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,72 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Network modes for a container
+const (
+	// Bridge connects the container to the host with a veth pair and NAT.
+	// Needs root.
+	Bridge = "bridge"
+	// Slirp gives the container user-mode networking through slirp4netns
+	Slirp = "slirp4netns"
+	// None leaves the container with only a loopback interface
+	None = "none"
+)
+
+// DefaultMode returns the network mode used when none is requested:
+// bridge for root, slirp4netns if installed when rootless
+func DefaultMode(rootless bool) string {
+	if !rootless {
+		return Bridge
+	}
+	if _, err := exec.LookPath("slirp4netns"); err == nil {
+		return Slirp
+	}
+	fmt.Fprintln(os.Stderr, "Warning: slirp4netns not found, rootless container has no network")
+	return None
+}
+
+// ValidMode reports whether mode is a known network mode
+func ValidMode(mode string) bool {
+	return mode == Bridge || mode == Slirp || mode == None
+}
+
+// Setup connects the network namespace of pid according to mode. The
+// returned function releases what Setup started.
+func Setup(mode, containerID string, pid int) (func(), error) {
+	switch mode {
+	case Bridge:
+		return func() {}, SetupVethPair(containerID, pid)
+	case Slirp:
+		return StartSlirp(pid)
+	default:
+		return func() {}, nil
+	}
+}
+
+// StartSlirp runs slirp4netns for the network namespace of pid. It adds a
+// configured tap0 with the default route; the container's address is
+// 10.0.2.100 and the host is not reachable through it.
+func StartSlirp(pid int) (func(), error) {
+	cmd := exec.Command("slirp4netns", "--configure", "--mtu=65520", "--disable-host-loopback", strconv.Itoa(pid), "tap0")
+	if err := cmd.Start(); err != nil {
+		return func() {}, fmt.Errorf("failed to start slirp4netns: %v", err)
+	}
+	return func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}, nil
+}
+
+// SetupLoopback brings up lo inside the container
+func SetupLoopback() error {
+	if err := exec.Command("ip", "link", "set", "lo", "up").Run(); err != nil {
+		return fmt.Errorf("failed to bring up loopback: %v", err)
+	}
+	return nil
+}
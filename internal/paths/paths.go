@@ -0,0 +1,37 @@
+// Package paths locates gocount's state on disk
+package paths
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Root holds containers, images, volumes and the rootfs cache. Rootless
+// users get their own, since they cannot write root's.
+var Root = root()
+
+func root() string {
+	if Rootless() {
+		return fmt.Sprintf("/tmp/gocount-%d", os.Geteuid())
+	}
+	return "/tmp/gocount"
+}
+
+// ConfigFile holds defaults for new containers: /etc/gocount/config.json,
+// or the user's config directory when rootless
+var ConfigFile = configFile()
+
+func configFile() string {
+	if Rootless() {
+		if dir, err := os.UserConfigDir(); err == nil {
+			return filepath.Join(dir, "gocount", "config.json")
+		}
+	}
+	return "/etc/gocount/config.json"
+}
+
+// Rootless reports whether gocount runs without root privileges
+func Rootless() bool {
+	return os.Geteuid() != 0
+}
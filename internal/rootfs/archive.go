@@ -0,0 +1,257 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// IDMapper maps the owner of a file on the host to its owner inside a
+// user namespace
+type IDMapper func(uid, gid int) (int, int)
+
+// WriteTar streams the tree under root as an uncompressed tar archive,
+// preserving ownership, permission bits, hard links, device nodes, xattrs
+// and modification times
+func WriteTar(w io.Writer, root string) error {
+	return WriteTarPaths(w, []string{root}, []string{""})
+}
+
+// WriteShiftedTar is like WriteTar for the rootfs of a container with a
+// user namespace: owners are stored as ids maps them
+func WriteShiftedTar(w io.Writer, root string, ids IDMapper) error {
+	tw := tar.NewWriter(w)
+	if err := writeTree(tw, map[inode]string{}, root, "", treeOptions{ids: ids}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// WriteTarPath is like WriteTar for a single file or directory, which is
+// stored in the archive under name
+func WriteTarPath(w io.Writer, path, name string) error {
+	return WriteTarPaths(w, []string{path}, []string{name})
+}
+
+// WriteTarPaths writes several files or directories into one archive,
+// storing paths[i] under names[i]
+func WriteTarPaths(w io.Writer, paths, names []string) error {
+	tw := tar.NewWriter(w)
+	links := map[inode]string{}
+	for i := range paths {
+		if err := writeTree(tw, links, paths[i], names[i], treeOptions{}); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// WriteLayerTar is like WriteTar for an overlayfs upper directory: overlay
+// whiteouts and opaque directories become ".wh." entries, so the result can
+// be applied on top of the lower layers
+func WriteLayerTar(w io.Writer, upperDir string) error {
+	return WriteShiftedLayerTar(w, upperDir, nil, nil)
+}
+
+// WriteShiftedLayerTar is like WriteLayerTar for a container with a user
+// namespace, whose upper dir holds a copy of every file ChownRootfs shifted.
+// Owners are stored as ids maps them, and files that are unchanged against
+// lowerDirs (topmost first) once mapped back are left out.
+func WriteShiftedLayerTar(w io.Writer, upperDir string, lowerDirs []string, ids IDMapper) error {
+	opts := treeOptions{overlayUpper: true, ids: ids}
+	if ids != nil {
+		lower, err := mergeLayers(lowerDirs)
+		if err != nil {
+			return err
+		}
+		opts.lower = lower
+	}
+	tw := tar.NewWriter(w)
+	if err := writeTree(tw, map[inode]string{}, upperDir, "", opts); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// inode identifies a file for hard link detection
+type inode struct{ dev, ino uint64 }
+
+// treeOptions adjust what writeTree stores
+type treeOptions struct {
+	// overlayUpper converts overlay whiteouts and opaque directories
+	overlayUpper bool
+	// ids maps owners, nil to store them as they are on the host
+	ids IDMapper
+	// lower holds the entries below an upper dir: files that do not
+	// differ from them are skipped. Directories are always kept.
+	lower map[string]layerEntry
+}
+
+// writeTree adds root to tw under prefix. links records the first archive
+// name of each multiply-linked inode.
+func writeTree(tw *tar.Writer, links map[inode]string, root, prefix string, opts treeOptions) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(filepath.Join(prefix, rel))
+		if fi.IsDir() {
+			name += "/"
+		}
+
+		if fi.Mode()&os.ModeSocket != 0 {
+			fmt.Fprintf(os.Stderr, "Warning: skipping socket %s\n", name)
+			return nil
+		}
+
+		if opts.overlayUpper && isOverlayWhiteout(fi) {
+			dir, base := filepath.Split(name)
+			return tw.WriteHeader(whiteoutHeader(dir + whiteoutPrefix + base))
+		}
+
+		if base, ok := opts.lower[filepath.Join("/", rel)]; ok && !fi.IsDir() {
+			changed, err := entryChanged(base, path, fi, opts.ids)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				return nil
+			}
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		header.Name = name
+		header.Format = tar.FormatPAX
+		// Names come from the host's passwd/group, which mean nothing here
+		header.Uname, header.Gname = "", ""
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+		if opts.ids != nil {
+			header.Uid, header.Gid = opts.ids(header.Uid, header.Gid)
+		}
+
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && !fi.IsDir() && st.Nlink > 1 {
+			key := inode{uint64(st.Dev), st.Ino}
+			if first, ok := links[key]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				links[key] = name
+			}
+		}
+
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		opaque := false
+		for attr, value := range xattrs {
+			if opts.overlayUpper && isOverlayXattr(attr) {
+				opaque = opaque || (strings.HasSuffix(attr, ".opaque") && value == "y")
+				continue
+			}
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
+			}
+			header.PAXRecords[xattrPrefix+attr] = value
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if opaque {
+			if err := tw.WriteHeader(whiteoutHeader(name + opaqueWhiteout)); err != nil {
+				return err
+			}
+		}
+		if header.Typeflag != tar.TypeReg || header.Size == 0 {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// isOverlayWhiteout reports whether fi is an overlayfs whiteout (a 0/0 char device)
+func isOverlayWhiteout(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+// isOverlayXattr reports whether attr is overlayfs bookkeeping, either
+// privileged (trusted.overlay.*) or from userxattr mounts (user.overlay.*)
+func isOverlayXattr(attr string) bool {
+	return strings.HasPrefix(attr, "trusted.overlay.") || strings.HasPrefix(attr, "user.overlay.")
+}
+
+func whiteoutHeader(name string) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	}
+}
+
+// readXattrs returns the extended attributes of path without following symlinks
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for _, attr := range strings.Split(string(buf[:size]), "\x00") {
+		if attr == "" {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(path, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(path, attr, value); err != nil {
+			return nil, err
+		}
+		xattrs[attr] = string(value[:vsize])
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,39 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestWriteShiftedLayerTar(t *testing.T) {
+	lower, upper, ids := shiftedLayers(t)
+
+	var buf bytes.Buffer
+	if err := WriteShiftedLayerTar(&buf, upper, []string{lower}, ids); err != nil {
+		t.Fatalf("WriteShiftedLayerTar: %v", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		if header.Uid != 0 || header.Gid != 0 {
+			t.Errorf("%s owned by %d:%d, want 0:0", header.Name, header.Uid, header.Gid)
+		}
+	}
+	// The merely chowned /same is left out, directories are kept
+	want := []string{"./", "dir/", "edited", "new"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("archive has %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,192 @@
+package rootfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gocount/internal/paths"
+)
+
+// CacheDir holds one entry per verified rootfs archive, keyed by its SHA-256:
+// <sha256>/archive is the downloaded file and <sha256>/rootfs the extracted
+// tree shared read-only by every container created from it
+var CacheDir = filepath.Join(paths.Root, "cache")
+
+// CacheEntry describes a cached rootfs
+type CacheEntry struct {
+	SHA256  string
+	URL     string
+	Created time.Time
+}
+
+// Dir returns the directory of the cache entry
+func (e *CacheEntry) Dir() string {
+	return filepath.Join(CacheDir, e.SHA256)
+}
+
+// ArchivePath returns the path of the cached archive
+func (e *CacheEntry) ArchivePath() string {
+	return filepath.Join(e.Dir(), "archive")
+}
+
+// TreeDir returns the path of the extracted rootfs
+func (e *CacheEntry) TreeDir() string {
+	return filepath.Join(e.Dir(), "rootfs")
+}
+
+// CachedRootfs returns the shared extracted tree for src, downloading and
+// extracting it only if no verified copy is cached yet
+func CachedRootfs(src Source) (string, error) {
+	// Validates the configured digest, which is also the cache key
+	v, err := newVerifier(src)
+	if err != nil {
+		return "", err
+	}
+	e := &CacheEntry{SHA256: v.wantSHA256, URL: src.URL, Created: time.Now()}
+	if isValidRootfs(e.TreeDir()) {
+		return e.TreeDir(), nil
+	}
+
+	if err := os.MkdirAll(e.Dir(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	if _, err := os.Stat(e.ArchivePath()); err != nil {
+		if err := fetchArchive(src, v, e.ArchivePath()); err != nil {
+			return "", err
+		}
+	}
+
+	if err := extractCached(e); err != nil {
+		return "", err
+	}
+	data, _ := json.Marshal(e)
+	if err := os.WriteFile(filepath.Join(e.Dir(), "entry.json"), data, 0644); err != nil {
+		return "", err
+	}
+	return e.TreeDir(), nil
+}
+
+// fetchArchive downloads src to path, keeping it only if it verifies
+func fetchArchive(src Source, v *verifier, path string) error {
+	fmt.Printf("Fetching %s...\n", src.URL)
+	rc, err := openLocation(src.URL)
+	if err != nil {
+		return fmt.Errorf("failed to download rootfs: %v", err)
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".archive-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(io.MultiWriter(tmp, v), rc)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download rootfs: %v", err)
+	}
+	if err := v.Verify(); err != nil {
+		return fmt.Errorf("rootfs verification failed for %s: %v", src.URL, err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// extractCached extracts the archive of e into a staging directory and
+// renames it into place. A concurrent extraction that finished first wins.
+func extractCached(e *CacheEntry) error {
+	f, err := os.Open(e.ArchivePath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	staging, err := os.MkdirTemp(e.Dir(), ".rootfs-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+	if err := os.Chmod(staging, 0755); err != nil {
+		return err
+	}
+
+	fmt.Println("Extracting rootfs...")
+	if err := ExtractArchive(f, staging); err != nil {
+		return fmt.Errorf("failed to extract rootfs: %v", err)
+	}
+
+	if isValidRootfs(e.TreeDir()) {
+		return nil
+	}
+	if err := os.RemoveAll(e.TreeDir()); err != nil {
+		return fmt.Errorf("failed to remove old rootfs: %v", err)
+	}
+	if err := os.Rename(staging, e.TreeDir()); err != nil {
+		return fmt.Errorf("failed to move rootfs into place: %v", err)
+	}
+	return nil
+}
+
+// ListCache returns the cached rootfs entries, oldest first
+func ListCache() ([]*CacheEntry, error) {
+	dirs, err := os.ReadDir(CacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []*CacheEntry
+	for _, d := range dirs {
+		// Anything else in the directory is not a cache entry
+		if !d.IsDir() || !isDigest(d.Name()) {
+			continue
+		}
+		e := &CacheEntry{SHA256: d.Name()}
+		if data, err := os.ReadFile(filepath.Join(e.Dir(), "entry.json")); err == nil {
+			json.Unmarshal(data, e)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Created.Before(entries[j].Created) })
+	return entries, nil
+}
+
+// InUse reports whether any of dirs (e.g. container lower dirs) is in the entry
+func (e *CacheEntry) InUse(dirs []string) bool {
+	for _, dir := range dirs {
+		if dir == e.TreeDir() || strings.HasPrefix(dir, e.Dir()+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Size returns the disk usage of the entry in bytes
+func (e *CacheEntry) Size() int64 {
+	var size int64
+	filepath.Walk(e.Dir(), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Remove deletes the entry from the cache
+func (e *CacheEntry) Remove() error {
+	if err := os.RemoveAll(e.Dir()); err != nil {
+		return fmt.Errorf("failed to remove cached rootfs %s: %v", e.SHA256, err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneTree copies the tree at src to dst, which must not exist. Regular
+// files are reflinked where the filesystem supports it, so the copy shares
+// data blocks with src until either side writes. Files are never hard
+// linked to src, since writes in the copy would change the original.
+func CloneTree(src, dst string) error {
+	src = filepath.Clean(src)
+	preserveOwner := os.Geteuid() == 0
+	links := map[inode]string{}
+
+	type dirTimes struct {
+		path   string
+		header *tar.Header
+	}
+	var dirs []dirTimes
+
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		header.Name = rel
+		header.AccessTime = time.Time{}
+
+		// Keep hard links within the tree linked in the copy
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && !fi.IsDir() && st.Nlink > 1 {
+			key := inode{uint64(st.Dev), st.Ino}
+			if first, ok := links[key]; ok {
+				return os.Link(first, target)
+			}
+			links[key] = target
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := cloneFile(path, target); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			st := fi.Sys().(*syscall.Stat_t)
+			if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				if errors.Is(err, unix.EPERM) {
+					fmt.Fprintf(os.Stderr, "Warning: cannot create device %s: %v\n", rel, err)
+					return nil
+				}
+				return fmt.Errorf("mknod %s: %v", rel, err)
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s\n", rel)
+			return nil
+		}
+
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", rel, err)
+		}
+		for attr, value := range xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
+			}
+			header.PAXRecords[xattrPrefix+attr] = value
+		}
+		if err := applyMetadata(target, header, preserveOwner); err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			dirs = append(dirs, dirTimes{target, header})
+			return nil
+		}
+		return setTimes(target, header)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setTimes(dirs[i].path, dirs[i].header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloneFile reflinks src to dst, falling back to copying the contents
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
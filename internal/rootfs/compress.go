@@ -0,0 +1,96 @@
+package rootfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Magic bytes of the supported compression formats
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	bzip2Magic = []byte{'B', 'Z', 'h'}
+)
+
+// ExtractArchive extracts a tar archive, compressed with gzip, zstd, xz or
+// bzip2 or not at all, into destPath
+func ExtractArchive(r io.Reader, destPath string) error {
+	tr, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	return extractTar(tr, destPath, whiteoutApply)
+}
+
+// ExtractLayer is like ExtractArchive but keeps whiteouts in overlayfs form,
+// so destPath can be used as a lower layer, and returns the SHA-256 of the
+// uncompressed tar stream, which identifies the layer
+func ExtractLayer(r io.Reader, destPath string) (string, error) {
+	tr, err := decompress(r)
+	if err != nil {
+		return "", err
+	}
+	defer tr.Close()
+
+	h := sha256.New()
+	if err := extractTar(io.TeeReader(tr, h), destPath, whiteoutOverlay); err != nil {
+		return "", err
+	}
+	// Include the padding after the end-of-archive marker
+	if _, err := io.Copy(h, tr); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// decompress detects the compression of r from its magic bytes and returns
+// a reader yielding the plain tar stream
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read archive header: %v", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+		}
+		return gzr, nil
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %v", err)
+		}
+		return zr.IOReadCloser(), nil
+
+	case bytes.HasPrefix(magic, xzMagic):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create xz reader: %v", err)
+		}
+		return io.NopCloser(xr), nil
+
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+
+	default:
+		// Assume an uncompressed tar; extractTar reports anything else
+		return io.NopCloser(br), nil
+	}
+}
@@ -0,0 +1,292 @@
+package rootfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Kinds of filesystem change, as printed by `gocount diff`
+const (
+	ChangeAdd    = "A"
+	ChangeModify = "C"
+	ChangeDelete = "D"
+)
+
+// Change is one path that differs from the base image
+type Change struct {
+	Kind string
+	Path string
+}
+
+// layerEntry is a path visible in a stack of layers
+type layerEntry struct {
+	path string // absolute path in the layer that provides it
+	info os.FileInfo
+}
+
+// mergeLayers flattens overlay-style layer directories (topmost first) into
+// a map from container path ("/etc/passwd") to the entry that is visible,
+// honouring whiteouts and opaque directories
+func mergeLayers(lowerDirs []string) (map[string]layerEntry, error) {
+	merged := map[string]layerEntry{}
+
+	for i := len(lowerDirs) - 1; i >= 0; i-- {
+		layer := lowerDirs[i]
+		// A layer only removes what the layers below it provide
+		below := make([]string, 0, len(merged))
+		for name := range merged {
+			below = append(below, name)
+		}
+		sort.Strings(below)
+
+		err := filepath.Walk(layer, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(layer, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			name := filepath.Join("/", rel)
+
+			if isOverlayWhiteout(fi) {
+				removeTree(merged, below, name)
+				return nil
+			}
+			// Anything but a directory replaces whatever was below; an opaque
+			// directory hides the lower contents
+			if prev, ok := merged[name]; ok && (!fi.IsDir() || !prev.info.IsDir() || isOpaque(path)) {
+				removeTree(merged, below, name)
+			}
+			merged[name] = layerEntry{path, fi}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return merged, nil
+}
+
+// OverlayChanges lists the changes recorded in an overlay upper directory
+// relative to its lower layers (topmost first). With ids, the upper dir
+// belongs to a user namespace and paths that only differ in their shifted
+// owner are left out.
+func OverlayChanges(upperDir string, lowerDirs []string, ids IDMapper) ([]Change, error) {
+	lower, err := mergeLayers(lowerDirs)
+	if err != nil {
+		return nil, err
+	}
+	lowerNames := make([]string, 0, len(lower))
+	for name := range lower {
+		lowerNames = append(lowerNames, name)
+	}
+	sort.Strings(lowerNames)
+
+	var changes []Change
+	err = filepath.Walk(upperDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upperDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.Join("/", rel)
+		_, inLower := lower[name]
+
+		if isOverlayWhiteout(fi) {
+			if inLower {
+				changes = append(changes, Change{ChangeDelete, name})
+			}
+			return nil
+		}
+
+		if !inLower {
+			changes = append(changes, Change{ChangeAdd, name})
+			return nil
+		}
+		opaque := fi.IsDir() && isOpaque(path)
+		if ids != nil && !opaque {
+			changed, err := entryChanged(lower[name], path, fi, ids)
+			if err != nil || !changed {
+				return err
+			}
+		}
+		changes = append(changes, Change{ChangeModify, name})
+
+		// Lower children hidden by an opaque directory are deleted, unless
+		// the upper directory has them too
+		if opaque {
+			prefix := name + "/"
+			for i := sort.SearchStrings(lowerNames, prefix); i < len(lowerNames) && strings.HasPrefix(lowerNames[i], prefix); i++ {
+				if child := lowerNames[i]; filepath.Dir(child) == name {
+					if _, err := os.Lstat(filepath.Join(upperDir, child)); os.IsNotExist(err) {
+						changes = append(changes, Change{ChangeDelete, child})
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortChanges(changes)
+	return changes, nil
+}
+
+// TreeChanges compares a full copy of a rootfs against the layers it was
+// created from (topmost first). Paths are compared by metadata and, when
+// only the timestamp differs, by content hash. ids maps the owners of both
+// trees, as in OverlayChanges.
+func TreeChanges(lowerDirs []string, dir string, ids IDMapper) ([]Change, error) {
+	lower, err := mergeLayers(lowerDirs)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	seen := map[string]bool{}
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.Join("/", rel)
+		seen[name] = true
+
+		base, ok := lower[name]
+		if !ok {
+			changes = append(changes, Change{ChangeAdd, name})
+			return nil
+		}
+		changed, err := entryChanged(base, path, fi, ids)
+		if err != nil {
+			return err
+		}
+		if changed {
+			changes = append(changes, Change{ChangeModify, name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Report only the topmost path of a deleted tree
+	for name := range lower {
+		if seen[name] {
+			continue
+		}
+		if parent := filepath.Dir(name); parent == "/" || seen[parent] {
+			changes = append(changes, Change{ChangeDelete, name})
+		}
+	}
+
+	sortChanges(changes)
+	return changes, nil
+}
+
+// entryChanged reports whether path differs from the base entry, comparing
+// owners as ids maps them if it is not nil
+func entryChanged(base layerEntry, path string, fi os.FileInfo, ids IDMapper) (bool, error) {
+	a, aok := base.info.Sys().(*syscall.Stat_t)
+	b, bok := fi.Sys().(*syscall.Stat_t)
+	if !aok || !bok {
+		return true, nil
+	}
+	auid, agid := int(a.Uid), int(a.Gid)
+	buid, bgid := int(b.Uid), int(b.Gid)
+	if ids != nil {
+		auid, agid = ids(auid, agid)
+		buid, bgid = ids(buid, bgid)
+	}
+	if a.Mode != b.Mode || auid != buid || agid != bgid || a.Rdev != b.Rdev {
+		return true, nil
+	}
+
+	switch fi.Mode().Type() {
+	case os.ModeDir:
+		return a.Mtim != b.Mtim, nil
+	case os.ModeSymlink:
+		x, err1 := os.Readlink(base.path)
+		y, err2 := os.Readlink(path)
+		return err1 != nil || err2 != nil || x != y, nil
+	case 0:
+		if a.Size != b.Size {
+			return true, nil
+		}
+		if a.Mtim == b.Mtim {
+			return false, nil
+		}
+		return contentDiffers(base.path, path)
+	}
+	return false, nil
+}
+
+// contentDiffers compares two regular files by SHA-256
+func contentDiffers(a, b string) (bool, error) {
+	ha, err := hashFile(a)
+	if err != nil {
+		return false, err
+	}
+	hb, err := hashFile(b)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(ha, hb), nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// isOpaque reports whether dir is marked opaque by overlayfs
+func isOpaque(dir string) bool {
+	for _, attr := range []string{overlayOpaqueXattr, userOpaqueXattr} {
+		buf := make([]byte, 1)
+		if n, err := syscall.Getxattr(dir, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// removeTree deletes name and everything below it from entries. sorted
+// holds the names to search, in order, so the subtree is one range of it.
+func removeTree(entries map[string]layerEntry, sorted []string, name string) {
+	delete(entries, name)
+	prefix := name + "/"
+	if name == "/" {
+		prefix = "/"
+	}
+	for i := sort.SearchStrings(sorted, prefix); i < len(sorted) && strings.HasPrefix(sorted[i], prefix); i++ {
+		delete(entries, sorted[i])
+	}
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+}
@@ -0,0 +1,141 @@
+package rootfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// layer creates a layer directory from paths, where a trailing slash makes
+// a directory, "name=wh" an overlay whiteout and "name/=opq" an opaque one
+func layer(t *testing.T, paths ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, p := range paths {
+		path := filepath.Join(dir, p)
+		var err error
+		switch {
+		case strings.HasSuffix(p, "=wh"):
+			path = strings.TrimSuffix(path, "=wh")
+			os.MkdirAll(filepath.Dir(path), 0755)
+			if err = unix.Mknod(path, unix.S_IFCHR, 0); errors.Is(err, unix.EPERM) {
+				t.Skipf("cannot create whiteouts: %v", err)
+			}
+		case strings.HasSuffix(p, "/=opq"):
+			path = filepath.Dir(path)
+			os.MkdirAll(path, 0755)
+			if err = unix.Setxattr(path, userOpaqueXattr, []byte("y"), 0); errors.Is(err, unix.ENOTSUP) {
+				t.Skipf("cannot mark opaque directories: %v", err)
+			}
+		case strings.HasSuffix(p, "/"):
+			err = os.MkdirAll(path, 0755)
+		default:
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = os.WriteFile(path, []byte(p), 0644)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestMergeLayers(t *testing.T) {
+	base := layer(t, "a/b/c", "a/d", "a-b/e", "a.b", "f/g", "h/i", "h/j/k")
+	middle := layer(t, "a/b=wh", "f=wh", "h/=opq", "h/x")
+	top := layer(t, "f/", "f/new", "a-b=wh")
+
+	merged, err := mergeLayers([]string{top, middle, base})
+	if err != nil {
+		t.Fatalf("mergeLayers: %v", err)
+	}
+	var names []string
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// a/b and everything in it are gone, the a-b and a.b siblings are not
+	// touched by the a/b whiteout; the opaque h hides i and j
+	want := []string{"/a", "/a.b", "/a/d", "/f", "/f/new", "/h", "/h/x"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("merged %v, want %v", names, want)
+	}
+	if got := merged["/f/new"].path; got != filepath.Join(top, "f/new") {
+		t.Errorf("/f/new from %s", got)
+	}
+}
+
+func TestOverlayChangesOpaque(t *testing.T) {
+	base := layer(t, "etc/a", "etc/b", "etc/sub/c", "etcx")
+	upper := layer(t, "etc/=opq", "etc/b", "new")
+
+	changes, err := OverlayChanges(upper, []string{base}, nil)
+	if err != nil {
+		t.Fatalf("OverlayChanges: %v", err)
+	}
+	want := []Change{
+		{ChangeModify, "/etc"},
+		{ChangeDelete, "/etc/a"},
+		{ChangeModify, "/etc/b"},
+		{ChangeDelete, "/etc/sub"},
+		{ChangeAdd, "/new"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes %v, want %v", changes, want)
+	}
+}
+
+// shiftedLayers returns a lower layer and an upper dir like ChownRootfs
+// leaves one: /same is only chowned to 100000, /edited is changed too and
+// /new is added. The returned mapper shifts 100000 back to 0.
+func shiftedLayers(t *testing.T) (lower, upper string, ids IDMapper) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to chown")
+	}
+	lower = layer(t, "same", "edited", "dir/")
+	upper = layer(t, "same", "edited", "new", "dir/")
+	if err := os.WriteFile(filepath.Join(upper, "edited"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"same", "edited", "new", "dir"} {
+		path := filepath.Join(upper, name)
+		if err := os.Lchown(path, 100000, 100000); err != nil {
+			t.Fatal(err)
+		}
+		if fi, err := os.Stat(filepath.Join(lower, name)); err == nil {
+			os.Chtimes(path, fi.ModTime(), fi.ModTime())
+		}
+	}
+	ids = func(uid, gid int) (int, int) {
+		if uid == 100000 {
+			uid = 0
+		}
+		if gid == 100000 {
+			gid = 0
+		}
+		return uid, gid
+	}
+	return lower, upper, ids
+}
+
+func TestOverlayChangesShifted(t *testing.T) {
+	lower, upper, ids := shiftedLayers(t)
+
+	changes, err := OverlayChanges(upper, []string{lower}, ids)
+	if err != nil {
+		t.Fatalf("OverlayChanges: %v", err)
+	}
+	want := []Change{{ChangeModify, "/edited"}, {ChangeAdd, "/new"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes %v, want %v", changes, want)
+	}
+}
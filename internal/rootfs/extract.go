@@ -0,0 +1,305 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gocount/internal/paths"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// PAX record prefix used for extended attributes (security.capability etc.)
+	xattrPrefix = "SCHILY.xattr."
+
+	// Layer whiteouts: ".wh.<name>" deletes <name> from lower layers and
+	// ".wh..wh..opq" hides all lower content of its directory
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+
+	// overlayfs representation of the same
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+	// Overlays mounted with userxattr use this instead
+	userOpaqueXattr = "user.overlay.opaque"
+)
+
+// opaqueXattr returns the opaque xattr the overlays of extracted layers
+// will read. Rootless layers are mounted inside the container's user
+// namespace and root may already be in one; both mount with userxattr.
+func opaqueXattr() string {
+	if paths.Rootless() || InUserNS() {
+		return userOpaqueXattr
+	}
+	return overlayOpaqueXattr
+}
+
+// whiteoutMode selects what extractTar does with whiteout entries
+type whiteoutMode int
+
+const (
+	// whiteoutApply deletes the whited-out paths, flattening the archive
+	// onto whatever is already in destPath
+	whiteoutApply whiteoutMode = iota
+	// whiteoutOverlay stores them as overlayfs whiteouts so destPath can be
+	// used as a lower layer
+	whiteoutOverlay
+)
+
+// extractTar extracts a tar archive to the destination path, restoring
+// ownership, permission bits, extended attributes and timestamps
+func extractTar(r io.Reader, destPath string, whiteouts whiteoutMode) error {
+	tr := tar.NewReader(r)
+	destPath = filepath.Clean(destPath)
+
+	// Paths written by this archive, which an opaque whiteout must keep
+	created := map[string]bool{}
+
+	// Ownership can only be restored by root; unprivileged extraction keeps
+	// the caller as owner of everything
+	preserveOwner := os.Geteuid() == 0
+
+	// Directory times are set last, since extracting children changes them
+	type dirTimes struct {
+		path   string
+		header *tar.Header
+	}
+	var dirs []dirTimes
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := entryPath(destPath, header.Name)
+		if err != nil {
+			return err
+		}
+
+		// Ensure the parent directory exists
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		if base := filepath.Base(target); strings.HasPrefix(base, whiteoutPrefix) {
+			if err := applyWhiteout(target, whiteouts, created); err != nil {
+				return fmt.Errorf("whiteout %s: %v", header.Name, err)
+			}
+			continue
+		}
+		created[target] = true
+
+		// Replace whatever is in the way, unless it's a directory being
+		// re-declared. Never write through an existing symlink.
+		if fi, err := os.Lstat(target); err == nil && target != destPath {
+			if !(fi.IsDir() && header.Typeflag == tar.TypeDir) {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+
+		case tar.TypeReg, tar.TypeGNUSparse:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			linkTarget, err := entryPath(destPath, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(linkTarget, target); err != nil {
+				return err
+			}
+			// A hard link shares its inode (and metadata) with the target
+			continue
+
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			mode := uint32(header.Mode & 07777)
+			switch header.Typeflag {
+			case tar.TypeChar:
+				mode |= unix.S_IFCHR
+			case tar.TypeBlock:
+				mode |= unix.S_IFBLK
+			default:
+				mode |= unix.S_IFIFO
+			}
+			dev := int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+			if err := unix.Mknod(target, mode, dev); err != nil {
+				if errors.Is(err, unix.EPERM) {
+					fmt.Fprintf(os.Stderr, "Warning: cannot create device %s: %v\n", header.Name, err)
+					continue
+				}
+				return fmt.Errorf("mknod %s: %v", header.Name, err)
+			}
+
+		case tar.TypeXGlobalHeader:
+			continue
+
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: skipping unsupported tar entry %s (type %q)\n", header.Name, header.Typeflag)
+			continue
+		}
+
+		if err := applyMetadata(target, header, preserveOwner); err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{target, header})
+		} else if err := setTimes(target, header); err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setTimes(dirs[i].path, dirs[i].header); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyWhiteout handles a ".wh." entry at target according to mode
+func applyWhiteout(target string, mode whiteoutMode, created map[string]bool) error {
+	dir, base := filepath.Split(target)
+	dir = filepath.Clean(dir)
+
+	if base == opaqueWhiteout {
+		if mode == whiteoutOverlay {
+			return unix.Lsetxattr(dir, opaqueXattr(), []byte("y"), 0)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			if !created[path] {
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	path := filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	if mode == whiteoutOverlay {
+		// overlayfs whiteouts are 0/0 character devices
+		return unix.Mknod(path, unix.S_IFCHR, 0)
+	}
+	return nil
+}
+
+// entryPath maps an archive name to a path under destPath. Names that
+// escape lexically are rejected, and the parent is resolved with SecureJoin
+// so symlinks extracted earlier can't redirect writes outside destPath.
+func entryPath(destPath, name string) (string, error) {
+	target := filepath.Join(destPath, name)
+
+	// Guard against zip-slip: ensure target stays inside destPath
+	if target != destPath && !strings.HasPrefix(target+string(os.PathSeparator), destPath+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal path in tar archive: %s", name)
+	}
+	if target == destPath {
+		return destPath, nil
+	}
+
+	rel, err := filepath.Rel(destPath, target)
+	if err != nil {
+		return "", err
+	}
+	parent, err := SecureJoin(destPath, filepath.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(rel)), nil
+}
+
+// applyMetadata restores owner, mode and xattrs. The order matters: chown
+// clears setuid bits and file capabilities, so it has to come first.
+func applyMetadata(path string, header *tar.Header, preserveOwner bool) error {
+	if preserveOwner {
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("chown %s: %v", header.Name, err)
+		}
+	}
+
+	if header.Typeflag != tar.TypeSymlink {
+		if err := unix.Chmod(path, uint32(header.Mode&07777)); err != nil {
+			return fmt.Errorf("chmod %s: %v", header.Name, err)
+		}
+	}
+
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, xattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, xattrPrefix)
+		if err := unix.Lsetxattr(path, attr, []byte(value), 0); err != nil {
+			// Not every filesystem or privilege level supports every namespace
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+				fmt.Fprintf(os.Stderr, "Warning: cannot set xattr %s on %s: %v\n", attr, header.Name, err)
+				continue
+			}
+			return fmt.Errorf("setxattr %s on %s: %v", attr, header.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// setTimes restores access and modification times without following symlinks
+func setTimes(path string, header *tar.Header) error {
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	ts := []unix.Timespec{timespec(atime), timespec(header.ModTime)}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("set times on %s: %v", header.Name, err)
+	}
+	return nil
+}
+
+func timespec(t time.Time) unix.Timespec {
+	if t.IsZero() {
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	}
+	return unix.NsecToTimespec(t.UnixNano())
+}
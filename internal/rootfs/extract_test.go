@@ -0,0 +1,329 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// entry is a tar header and, for regular files, its content
+type entry struct {
+	tar.Header
+	body string
+}
+
+func archive(t *testing.T, entries ...entry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := e.Header
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(e.body))
+		}
+		if h.Format == tar.FormatUnknown && len(h.PAXRecords) > 0 {
+			h.Format = tar.FormatPAX
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatalf("WriteHeader %s: %v", h.Name, err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("Write %s: %v", h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func dir(name string, mode int64) entry {
+	return entry{Header: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: mode}}
+}
+
+func file(name string, mode int64, body string) entry {
+	return entry{Header: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode}, body: body}
+}
+
+func symlink(name, dest string) entry {
+	return entry{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: dest, Mode: 0777}}
+}
+
+func hardlink(name, dest string) entry {
+	return entry{Header: tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: dest}}
+}
+
+// extract unpacks entries into a fresh directory, returning it and the
+// directory around it that an escaping entry would write to
+func extract(t *testing.T, entries ...entry) (dest, outside string, err error) {
+	t.Helper()
+	outside = t.TempDir()
+	dest = filepath.Join(outside, "rootfs")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dest, outside, extractTar(archive(t, entries...), dest, whiteoutApply)
+}
+
+func stat(t *testing.T, path string) *syscall.Stat_t {
+	t.Helper()
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		t.Fatalf("lstat: %v", err)
+	}
+	return &st
+}
+
+func TestExtractFiles(t *testing.T) {
+	owned := file("etc/shadow", 0640, "root:*:")
+	owned.Uid, owned.Gid = 0, 42
+	daemon := file("var/lib/daemon", 0600, "data")
+	daemon.Uid, daemon.Gid = 1, 1
+
+	dest, _, err := extract(t,
+		dir("bin", 0755),
+		file("bin/su", 04755, "#!/bin/sh"),
+		file("bin/wall", 02755, "#!/bin/sh"),
+		dir("tmp", 01777),
+		dir("etc", 0755),
+		owned,
+		daemon,
+		symlink("bin/sh", "busybox"),
+	)
+	if err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	modes := map[string]os.FileMode{
+		"bin":            0755 | os.ModeDir,
+		"bin/su":         0755 | os.ModeSetuid,
+		"bin/wall":       0755 | os.ModeSetgid,
+		"tmp":            0777 | os.ModeDir | os.ModeSticky,
+		"etc/shadow":     0640,
+		"var/lib/daemon": 0600,
+	}
+	for name, want := range modes {
+		fi, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if fi.Mode() != want {
+			t.Errorf("%s: mode %v, want %v", name, fi.Mode(), want)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "etc/shadow")); string(data) != "root:*:" {
+		t.Errorf("etc/shadow: content %q", data)
+	}
+	if link, _ := os.Readlink(filepath.Join(dest, "bin/sh")); link != "busybox" {
+		t.Errorf("bin/sh: links to %q", link)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Log("not root, owners are not restored")
+		return
+	}
+	for name, want := range map[string][2]uint32{"etc/shadow": {0, 42}, "var/lib/daemon": {1, 1}} {
+		st := stat(t, filepath.Join(dest, name))
+		if st.Uid != want[0] || st.Gid != want[1] {
+			t.Errorf("%s: owner %d:%d, want %d:%d", name, st.Uid, st.Gid, want[0], want[1])
+		}
+	}
+}
+
+func TestExtractXattrs(t *testing.T) {
+	f := file("bin/ping", 0755, "elf")
+	f.PAXRecords = map[string]string{
+		xattrPrefix + "user.gocount": "value",
+		"mtime":                      "1700000000",
+	}
+	dest, _, err := extract(t, f)
+	if err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := unix.Lgetxattr(filepath.Join(dest, "bin/ping"), "user.gocount", buf)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("filesystem has no user xattrs")
+	}
+	if err != nil {
+		t.Fatalf("getxattr: %v", err)
+	}
+	if got := string(buf[:n]); got != "value" {
+		t.Errorf("xattr %q, want %q", got, "value")
+	}
+}
+
+func TestExtractHardlinks(t *testing.T) {
+	dest, _, err := extract(t,
+		file("bin/busybox", 0755, "elf"),
+		hardlink("bin/ls", "bin/busybox"),
+		hardlink("usr/bin/cat", "/bin/busybox"),
+	)
+	if err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+	ino := stat(t, filepath.Join(dest, "bin/busybox")).Ino
+	for _, name := range []string{"bin/ls", "usr/bin/cat"} {
+		if got := stat(t, filepath.Join(dest, name)).Ino; got != ino {
+			t.Errorf("%s: inode %d, want %d", name, got, ino)
+		}
+	}
+}
+
+func TestExtractDirTimes(t *testing.T) {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	d := dir("usr", 0755)
+	d.ModTime = mtime
+	sub := dir("usr/share", 0755)
+	sub.ModTime = mtime.Add(time.Hour)
+
+	f := file("usr/share/file", 0644, "x")
+	f.ModTime = mtime.Add(2 * time.Hour)
+
+	// The children come after their directories, as in any archive
+	dest, _, err := extract(t, d, sub, f, file("usr/other", 0644, "y"))
+	if err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+	for name, want := range map[string]time.Time{
+		"usr":            mtime,
+		"usr/share":      mtime.Add(time.Hour),
+		"usr/share/file": mtime.Add(2 * time.Hour),
+	} {
+		fi, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(want) {
+			t.Errorf("%s: mtime %v, want %v", name, fi.ModTime().UTC(), want)
+		}
+	}
+}
+
+func TestExtractDevices(t *testing.T) {
+	null := entry{Header: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3}}
+	loop := entry{Header: tar.Header{Typeflag: tar.TypeBlock, Name: "dev/loop0", Mode: 0660, Devmajor: 7, Devminor: 0}}
+	fifo := entry{Header: tar.Header{Typeflag: tar.TypeFifo, Name: "run/initctl", Mode: 0600}}
+
+	dest, _, err := extract(t, null, loop, fifo)
+	if err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	// FIFOs need no privileges
+	if fi, err := os.Lstat(filepath.Join(dest, "run/initctl")); err != nil || fi.Mode() != os.ModeNamedPipe|0600 {
+		t.Errorf("run/initctl: %v %v", fi, err)
+	}
+
+	probe := filepath.Join(t.TempDir(), "probe")
+	canMknod := unix.Mknod(probe, unix.S_IFCHR|0600, int(unix.Mkdev(1, 3))) == nil
+	for _, e := range []entry{null, loop} {
+		path := filepath.Join(dest, e.Name)
+		if !canMknod {
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("%s: created without CAP_MKNOD", e.Name)
+			}
+			continue
+		}
+		st := stat(t, path)
+		if unix.Major(st.Rdev) != uint32(e.Devmajor) || unix.Minor(st.Rdev) != uint32(e.Devminor) {
+			t.Errorf("%s: device %d:%d", e.Name, unix.Major(st.Rdev), unix.Minor(st.Rdev))
+		}
+		if os.FileMode(st.Mode&0777) != os.FileMode(e.Mode) {
+			t.Errorf("%s: mode %o, want %o", e.Name, st.Mode&0777, e.Mode)
+		}
+	}
+}
+
+func TestExtractRejectsEscapes(t *testing.T) {
+	tests := map[string][]entry{
+		"dot-dot":          {file("../evil", 0644, "x")},
+		"nested dot-dot":   {file("etc/../../evil", 0644, "x")},
+		"hardlink outside": {hardlink("evil", "../evil")},
+	}
+	for name, entries := range tests {
+		_, outside, err := extract(t, entries...)
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+			t.Errorf("%s: wrote outside the target", name)
+		}
+	}
+}
+
+func TestExtractSymlinksStayInside(t *testing.T) {
+	tests := map[string][]entry{
+		"absolute name":          {file("/evil", 0644, "x")},
+		"absolute symlink":       {symlink("root", "/"), file("root/evil", 0644, "x")},
+		"absolute symlink to it": {symlink("up", os.TempDir()), file("up/evil", 0644, "x")},
+		"relative symlink":       {symlink("up", "../../.."), file("up/evil", 0644, "x")},
+		"symlink in symlink":     {symlink("a", "b"), symlink("b", ".."), file("a/evil", 0644, "x")},
+		"hardlink via symlink":   {file("secret", 0644, "x"), symlink("up", ".."), hardlink("evil", "up/secret")},
+		"overwritten symlink":    {symlink("evil", "../evil"), file("evil", 0644, "x")},
+		"directory over symlink": {symlink("etc", ".."), dir("etc", 0755), file("etc/evil", 0644, "x")},
+	}
+	for name, entries := range tests {
+		dest, outside, err := extract(t, entries...)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+			t.Errorf("%s: wrote outside the target", name)
+		}
+		if _, err := os.Lstat(filepath.Join(os.TempDir(), "evil")); err == nil {
+			t.Errorf("%s: wrote to %s", name, os.TempDir())
+		}
+
+		// Whatever was written landed inside
+		found := false
+		filepath.Walk(dest, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() && strings.HasSuffix(path, "/evil") {
+				found = true
+			}
+			return nil
+		})
+		if !found {
+			t.Errorf("%s: file not extracted inside the target", name)
+		}
+	}
+}
+
+func TestExtractOverlayWhiteouts(t *testing.T) {
+	dest := t.TempDir()
+	layer := archive(t,
+		dir("etc", 0755),
+		file("etc/.wh..wh..opq", 0644, ""),
+		file("etc/hosts", 0644, "x"),
+		file(".wh.tmp", 0644, ""),
+	)
+	if err := extractTar(layer, dest, whiteoutOverlay); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	// The overlay this layer goes into reads only one of the two
+	buf := make([]byte, 1)
+	attr := opaqueXattr()
+	if n, err := unix.Lgetxattr(filepath.Join(dest, "etc"), attr, buf); err != nil || n != 1 || buf[0] != 'y' {
+		t.Errorf("etc: %s not set: %v", attr, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "etc/.wh..wh..opq")); !os.IsNotExist(err) {
+		t.Errorf("opaque marker extracted as a file")
+	}
+
+	st := stat(t, filepath.Join(dest, "tmp"))
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("tmp: mode %o rdev %d, want a 0/0 character device", st.Mode, st.Rdev)
+	}
+}
@@ -1,8 +1,6 @@
 package rootfs
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,18 +12,31 @@ import (
 const (
 	// Alpine Linux minirootfs - small and reliable
 	DefaultRootfsURL = "https://dl-cdn.alpinelinux.org/alpine/v3.19/releases/x86_64/alpine-minirootfs-3.19.1-x86_64.tar.gz"
-
+	// Published SHA-256 of DefaultRootfsURL
+	DefaultRootfsSHA256 = "185123ceb6e7d08f2449fff5543db206ffb79decd814608d399ad447e08fa29e"
 )
 
-// EnsureRootfs checks if rootfs exists and is valid, downloads if needed
-func EnsureRootfs(RootfsDir string) error {
-	// Check if rootfs exists and has basic directories
-	if isValidRootfs(RootfsDir) {
-		return nil
-	}
+// Checksums maps known rootfs URLs to their expected SHA-256 digests
+var Checksums = map[string]string{
+	DefaultRootfsURL: DefaultRootfsSHA256,
+}
+
+// Source describes where a rootfs tarball comes from and how to verify it
+type Source struct {
+	URL    string
+	SHA256 string
+	// Optional minisign signature; PublicKey enables the check and
+	// SignatureURL defaults to URL + ".minisig"
+	SignatureURL string
+	PublicKey    string
+}
 
-	fmt.Println("Rootfs not found or invalid. Downloading Alpine Linux rootfs...")
-	return DownloadAndExtractRootfs(DefaultRootfsURL, RootfsDir)
+// SourceFor returns a Source for url, filling in a known checksum if any
+func SourceFor(url string) Source {
+	if url == "" {
+		url = DefaultRootfsURL
+	}
+	return Source{URL: url, SHA256: Checksums[url]}
 }
 
 // isValidRootfs checks if the rootfs directory contains a valid filesystem
@@ -50,101 +61,19 @@ func isValidRootfs(rootfsPath string) bool {
 	return true
 }
 
-// DownloadAndExtractRootfs downloads and extracts a rootfs tarball
-func DownloadAndExtractRootfs(url, destPath string) error {
-	// Create rootfs directory if it doesn't exist
-	if err := os.MkdirAll(destPath, 0755); err != nil {
-		return fmt.Errorf("failed to create rootfs directory: %v", err)
+// openLocation opens an http(s) URL, a file:// URL or a local path
+func openLocation(location string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return os.Open(strings.TrimPrefix(location, "file://"))
 	}
 
-	// Download the tarball
-	fmt.Printf("Downloading from %s...\n", url)
-	resp, err := http.Get(url)
+	resp, err := http.Get(location)
 	if err != nil {
-		return fmt.Errorf("failed to download rootfs: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download rootfs: HTTP %d", resp.StatusCode)
-	}
-
-	// Create gzip reader
-	gzr, err := gzip.NewReader(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %v", err)
-	}
-	defer gzr.Close()
-
-	// Extract tarball
-	fmt.Println("Extracting rootfs...")
-	if err := extractTar(gzr, destPath); err != nil {
-		return fmt.Errorf("failed to extract rootfs: %v", err)
-	}
-
-	fmt.Println("Rootfs setup complete!")
-	return nil
-}
-
-// extractTar extracts a tar archive to the destination path
-func extractTar(r io.Reader, destPath string) error {
-	tr := tar.NewReader(r)
-
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-
-		target := filepath.Join(destPath, header.Name)
-
-		// Guard against zip-slip: ensure target stays inside destPath
-		if !strings.HasPrefix(filepath.Clean(target)+string(os.PathSeparator), filepath.Clean(destPath)+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal path in tar archive: %s", header.Name)
-		}
-
-		// Ensure the parent directory exists
-		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-			return err
-		}
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-				return err
-			}
-
-		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(f, tr); err != nil {
-				f.Close()
-				return err
-			}
-			f.Close()
-
-		case tar.TypeSymlink:
-			if err := os.Symlink(header.Linkname, target); err != nil && !os.IsExist(err) {
-				return err
-			}
-
-		case tar.TypeLink:
-			linkTarget := filepath.Join(destPath, header.Linkname)
-			if err := os.Link(linkTarget, target); err != nil && !os.IsExist(err) {
-				return err
-			}
-		}
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
 	}
-
-	return nil
-}
-
-// GetRootfsPath returns the path to the rootfs directory
-func GetRootfsPath(RootfsDir string) string {
-	return RootfsDir
+	return resp.Body, nil
 }
@@ -0,0 +1,70 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// MountOverlay mounts an overlay filesystem at target. lowerDirs are listed
+// topmost first, as overlayfs expects.
+func MountOverlay(lowerDirs []string, upperDir, workDir, target string) error {
+	if len(lowerDirs) == 0 {
+		return fmt.Errorf("overlay needs at least one lower directory")
+	}
+	for _, dir := range []string{upperDir, workDir, target} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(lowerDirs, ":"), upperDir, workDir)
+	if InUserNS() {
+		// trusted.* xattrs are off limits, so keep overlay's in user.*.
+		// Must agree with opaqueXattr, which layers were extracted with.
+		opts += ",userxattr"
+	}
+	if err := unix.Mount("overlay", target, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("mount overlay on %s: %v", target, err)
+	}
+	return nil
+}
+
+// InUserNS reports whether we run in a user namespace other than the
+// initial one
+func InUserNS() bool {
+	data, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data))
+	return len(fields) != 3 || fields[0] != "0" || fields[1] != "0" || fields[2] != "4294967295"
+}
+
+// Unmount detaches the filesystem mounted at target, if any
+func Unmount(target string) error {
+	if !IsMountpoint(target) {
+		return nil
+	}
+	if err := unix.Unmount(target, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount %s: %v", target, err)
+	}
+	return nil
+}
+
+// IsMountpoint reports whether path is on a different device than its parent
+func IsMountpoint(path string) bool {
+	var st, parent syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return false
+	}
+	if err := syscall.Lstat(filepath.Dir(filepath.Clean(path)), &parent); err != nil {
+		return false
+	}
+	return st.Dev != parent.Dev || st.Ino == parent.Ino
+}
@@ -0,0 +1,69 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks bounds symlink resolution in SecureJoin, like the kernel's ELOOP
+const maxSymlinks = 255
+
+// SecureJoin joins unsafePath onto root, resolving symlinks as if root were
+// "/" so the result can never point outside root. Components that do not
+// exist yet are joined lexically.
+func SecureJoin(root, unsafePath string) (string, error) {
+	root = filepath.Clean(root)
+	resolved := "/"
+	remaining := unsafePath
+	links := 0
+
+	for remaining != "" {
+		// Pop the next path component
+		remaining = strings.TrimLeft(remaining, "/")
+		part := remaining
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			part, remaining = remaining[:i], remaining[i:]
+		} else {
+			remaining = ""
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", unsafePath)
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(dest) {
+			resolved = "/"
+		}
+		remaining = dest + "/" + remaining
+	}
+
+	return filepath.Join(root, resolved), nil
+}
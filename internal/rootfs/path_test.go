@@ -0,0 +1,63 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"etc", "usr/lib", "var"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"abs":        "/etc",
+		"up":         "../../..",
+		"lib":        "usr/lib",
+		"var/escape": "../../../../tmp",
+		"chain":      "lib",
+		"loop1":      "loop2",
+		"loop2":      "loop1",
+	}
+	for name, dest := range links {
+		if err := os.Symlink(dest, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"etc/passwd", "/etc/passwd"},
+		{"/etc/../usr", "/usr"},
+		{"../../etc", "/etc"},
+		{"abs/passwd", "/etc/passwd"},
+		{"up", "/"},
+		{"up/etc", "/etc"},
+		{"lib/libc.so", "/usr/lib/libc.so"},
+		{"chain/x", "/usr/lib/x"},
+		{"var/escape/x", "/tmp/x"},
+		{"missing/../abs", "/etc"},
+		{"missing/deeper", "/missing/deeper"},
+	}
+	for _, tt := range tests {
+		got, err := SecureJoin(root, tt.path)
+		if err != nil {
+			t.Errorf("SecureJoin(%q): %v", tt.path, err)
+			continue
+		}
+		if want := filepath.Join(root, tt.want); got != want {
+			t.Errorf("SecureJoin(%q) = %q, want %q", tt.path, got, want)
+		}
+	}
+
+	if _, err := SecureJoin(root, "loop1/x"); err == nil {
+		t.Errorf("SecureJoin resolved a symlink loop")
+	}
+}
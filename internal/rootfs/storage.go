@@ -0,0 +1,135 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ParseSize converts sizes such as "512M" or "2G" (powers of 1024) to bytes
+func ParseSize(s string) (int64, error) {
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if str != "" {
+		if i := strings.IndexByte("KMGT", str[len(str)-1]); i >= 0 {
+			mult <<= 10 * (i + 1)
+			str = str[:len(str)-1]
+		}
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid size: %q is too large", s)
+	}
+	return n * mult, nil
+}
+
+// MountStorage mounts the ext4 filesystem in imagePath at target through a
+// loop device, creating a sparse image of size bytes on first use. Writes
+// beyond the size fail with ENOSPC.
+func MountStorage(imagePath string, size int64, target string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", target, err)
+	}
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		if err := createStorage(imagePath, size); err != nil {
+			return err
+		}
+	}
+
+	loop, err := attachLoop(imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to attach %s: %v", imagePath, err)
+	}
+	defer loop.Close()
+
+	if err := unix.Mount(loop.Name(), target, "ext4", 0, ""); err != nil {
+		return fmt.Errorf("mount %s on %s: %v", imagePath, target, err)
+	}
+	return nil
+}
+
+// createStorage makes a sparse ext4 image of size bytes
+func createStorage(imagePath string, size int64) error {
+	tmp := imagePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create storage image: %v", err)
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to create storage image: %v", err)
+	}
+
+	// No reserved blocks: the whole size is usable by the container
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", "-E", "root_owner=0:0", tmp).CombinedOutput()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("mkfs.ext4 failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(tmp, imagePath)
+}
+
+// attachLoop binds imagePath to a free loop device. The device detaches
+// itself once the filesystem on it is unmounted.
+func attachLoop(imagePath string) (*os.File, error) {
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.Close()
+
+	img, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	// Another process may grab the same free device; retry with the next one
+	for attempt := 0; attempt < 10; attempt++ {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, err
+		}
+		loop, err := os.OpenFile(fmt.Sprintf("/dev/loop%d", n), os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		err = unix.IoctlLoopConfigure(int(loop.Fd()), &unix.LoopConfig{
+			Fd:   uint32(img.Fd()),
+			Info: unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR},
+		})
+		if err == nil {
+			return loop, nil
+		}
+		loop.Close()
+		if !errors.Is(err, unix.EBUSY) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free loop device")
+}
+
+// StorageUsage returns the used and total bytes of the filesystem at path
+func StorageUsage(path string) (used, total uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	total = st.Blocks * uint64(st.Bsize)
+	used = (st.Blocks - st.Bfree) * uint64(st.Bsize)
+	return used, total, nil
+}
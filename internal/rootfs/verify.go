@@ -0,0 +1,195 @@
+package rootfs
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// verifier hashes a rootfs archive as it streams past and checks the
+// result against the expected SHA-256 and, optionally, a minisign signature
+type verifier struct {
+	wantSHA256 string
+	sha        hash.Hash
+	blake      hash.Hash
+	key        *minisignKey
+	sig        *minisignSignature
+}
+
+// isDigest reports whether s is a lowercase hex SHA-256 digest
+func isDigest(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == sha256.Size*2 && s == strings.ToLower(s)
+}
+
+func newVerifier(src Source) (*verifier, error) {
+	if src.SHA256 == "" {
+		return nil, fmt.Errorf("no SHA-256 configured for %s", src.URL)
+	}
+	want := strings.ToLower(strings.TrimSpace(src.SHA256))
+	if !isDigest(want) {
+		return nil, fmt.Errorf("invalid SHA-256 for %s: %q", src.URL, src.SHA256)
+	}
+
+	v := &verifier{wantSHA256: want, sha: sha256.New()}
+	if src.PublicKey == "" {
+		return v, nil
+	}
+
+	key, err := parseMinisignPublicKey(src.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sigURL := src.SignatureURL
+	if sigURL == "" {
+		sigURL = src.URL + ".minisig"
+	}
+	sigData, err := fetchSmall(sigURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signature: %v", err)
+	}
+	sig, err := parseMinisignSignature(sigData)
+	if err != nil {
+		return nil, err
+	}
+	if sig.keyID != key.keyID {
+		return nil, fmt.Errorf("signature key ID %X does not match public key %X", sig.keyID, key.keyID)
+	}
+
+	blake, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	v.key, v.sig, v.blake = key, sig, blake
+	return v, nil
+}
+
+// Write feeds archive bytes into every configured hash
+func (v *verifier) Write(p []byte) (int, error) {
+	v.sha.Write(p)
+	if v.blake != nil {
+		v.blake.Write(p)
+	}
+	return len(p), nil
+}
+
+// Verify checks the digests of everything written so far
+func (v *verifier) Verify() error {
+	got := hex.EncodeToString(v.sha.Sum(nil))
+	if got != v.wantSHA256 {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", v.wantSHA256, got)
+	}
+	if v.sig == nil {
+		return nil
+	}
+	if !ed25519.Verify(v.key.key, v.blake.Sum(nil), v.sig.signature) {
+		return fmt.Errorf("signature verification failed")
+	}
+	global := append(append([]byte{}, v.sig.signature...), v.sig.trustedComment...)
+	if !ed25519.Verify(v.key.key, global, v.sig.globalSignature) {
+		return fmt.Errorf("trusted comment signature verification failed")
+	}
+	return nil
+}
+
+type minisignKey struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+type minisignSignature struct {
+	keyID           [8]byte
+	signature       []byte
+	trustedComment  string
+	globalSignature []byte
+}
+
+// parseMinisignPublicKey accepts a base64 key, the contents of a .pub file,
+// or a path to one
+func parseMinisignPublicKey(s string) (*minisignKey, error) {
+	if data, err := os.ReadFile(s); err == nil {
+		s = string(data)
+	}
+
+	var line string
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "untrusted comment:") {
+			continue
+		}
+		line = l
+		break
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return nil, fmt.Errorf("invalid public key: not a minisign Ed25519 key")
+	}
+
+	k := &minisignKey{key: ed25519.PublicKey(raw[10:])}
+	copy(k.keyID[:], raw[2:10])
+	return k, nil
+}
+
+// parseMinisignSignature parses a .minisig file. Only prehashed ("ED")
+// signatures are accepted, since the archive is verified while streaming.
+func parseMinisignSignature(data []byte) (*minisignSignature, error) {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if len(lines) < 4 {
+		return nil, fmt.Errorf("invalid signature: too short")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	if len(raw) != 2+8+ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature: unexpected length %d", len(raw))
+	}
+	switch string(raw[:2]) {
+	case "ED":
+	case "Ed":
+		return nil, fmt.Errorf("legacy (non-prehashed) minisign signatures are not supported")
+	default:
+		return nil, fmt.Errorf("invalid signature: unknown algorithm %q", raw[:2])
+	}
+
+	const trustedPrefix = "trusted comment: "
+	if !strings.HasPrefix(lines[2], trustedPrefix) {
+		return nil, fmt.Errorf("invalid signature: missing trusted comment")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature: bad global signature")
+	}
+
+	sig := &minisignSignature{
+		signature:       raw[10:],
+		trustedComment:  strings.TrimPrefix(lines[2], trustedPrefix),
+		globalSignature: global,
+	}
+	copy(sig.keyID[:], raw[2:10])
+	return sig, nil
+}
+
+// fetchSmall reads a small file (signature, public key) from a URL or path
+func fetchSmall(location string) ([]byte, error) {
+	rc, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(io.LimitReader(rc, 64*1024))
+}
@@ -0,0 +1,341 @@
+package seccomp
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Offsets into struct seccomp_data
+const (
+	offNr   = 0
+	offArch = 4
+	offArgs = 16
+)
+
+// archNames are the libseccomp names of the architectures we build for
+var archNames = map[uint32]string{
+	unix.AUDIT_ARCH_X86_64:  "SCMP_ARCH_X86_64",
+	unix.AUDIT_ARCH_AARCH64: "SCMP_ARCH_AARCH64",
+}
+
+// x32Bit marks x32 syscall numbers on x86_64
+const x32Bit = 0x40000000
+
+// instruction is a BPF instruction whose jumps go to labels
+type instruction struct {
+	unix.SockFilter
+	jt, jf, ja string
+}
+
+// assembler builds a program with forward jumps to named labels. An empty
+// label means the next instruction.
+type assembler struct {
+	prog   []instruction
+	labels map[string]int
+	next   int
+}
+
+func newAssembler() *assembler {
+	return &assembler{labels: map[string]int{}}
+}
+
+// newLabel returns a label name not used before
+func (a *assembler) newLabel() string {
+	a.next++
+	return fmt.Sprintf("L%d", a.next)
+}
+
+// mark places label at the next instruction
+func (a *assembler) mark(label string) {
+	a.labels[label] = len(a.prog)
+}
+
+func (a *assembler) load(off uint32) {
+	a.prog = append(a.prog, instruction{SockFilter: unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: off}})
+}
+
+func (a *assembler) and(k uint32) {
+	a.prog = append(a.prog, instruction{SockFilter: unix.SockFilter{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: k}})
+}
+
+// jump compares the accumulator with k using op (BPF_JEQ, BPF_JGT or
+// BPF_JGE) and jumps to jt if true, jf if not
+func (a *assembler) jump(op uint16, k uint32, jt, jf string) {
+	a.prog = append(a.prog, instruction{SockFilter: unix.SockFilter{Code: unix.BPF_JMP | op | unix.BPF_K, K: k}, jt: jt, jf: jf})
+}
+
+func (a *assembler) jumpAlways(label string) {
+	a.prog = append(a.prog, instruction{SockFilter: unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JA}, ja: label})
+}
+
+func (a *assembler) ret(k uint32) {
+	a.prog = append(a.prog, instruction{SockFilter: unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: k}})
+}
+
+// offset returns the distance of a jump at i to label
+func (a *assembler) offset(i int, label string, max int) (int, error) {
+	if label == "" {
+		return 0, nil
+	}
+	target, ok := a.labels[label]
+	if !ok {
+		return 0, fmt.Errorf("undefined label %s", label)
+	}
+	off := target - i - 1
+	if off < 0 || off > max {
+		return 0, fmt.Errorf("jump from %d to %d out of range", i, target)
+	}
+	return off, nil
+}
+
+// assemble resolves the labels
+func (a *assembler) assemble() ([]unix.SockFilter, error) {
+	out := make([]unix.SockFilter, len(a.prog))
+	for i, ins := range a.prog {
+		out[i] = ins.SockFilter
+		if ins.SockFilter.Code == unix.BPF_JMP|unix.BPF_JA {
+			off, err := a.offset(i, ins.ja, 1<<31-1)
+			if err != nil {
+				return nil, err
+			}
+			out[i].K = uint32(off)
+			continue
+		}
+		jt, err := a.offset(i, ins.jt, 255)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := a.offset(i, ins.jf, 255)
+		if err != nil {
+			return nil, err
+		}
+		out[i].Jt, out[i].Jf = uint8(jt), uint8(jf)
+	}
+	if len(out) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("filter has %d instructions, more than the kernel allows", len(out))
+	}
+	return out, nil
+}
+
+// actionValue converts an action to the value the filter returns
+func actionValue(action Action, errnoRet *uint) (uint32, error) {
+	switch action {
+	case ActKill, ActKillThread:
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case ActKillProcess:
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case ActTrap:
+		return unix.SECCOMP_RET_TRAP, nil
+	case ActErrno:
+		errno := uint32(unix.EPERM)
+		if errnoRet != nil {
+			errno = uint32(*errnoRet)
+		}
+		return unix.SECCOMP_RET_ERRNO | errno&unix.SECCOMP_RET_DATA, nil
+	case ActTrace:
+		return unix.SECCOMP_RET_TRACE, nil
+	case ActLog:
+		return unix.SECCOMP_RET_LOG, nil
+	case ActAllow:
+		return unix.SECCOMP_RET_ALLOW, nil
+	}
+	return 0, fmt.Errorf("unknown action %q", action)
+}
+
+// applies reports whether the rule is used for a container holding caps
+func (s *Syscall) applies(caps map[string]bool) bool {
+	for _, c := range s.Includes.Caps {
+		if !caps[c] {
+			return false
+		}
+	}
+	for _, c := range s.Excludes.Caps {
+		if caps[c] {
+			return false
+		}
+	}
+	arch := archNames[nativeArch]
+	if len(s.Includes.Arches) > 0 && !contains(s.Includes.Arches, arch) {
+		return false
+	}
+	return !contains(s.Excludes.Arches, arch)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Compile translates the profile to a BPF program for a container holding
+// caps. Rules are checked in order and the first match wins. Syscalls that
+// do not exist on this architecture are skipped, as libseccomp does, and
+// syscalls of other architectures (such as 32-bit calls on x86_64) fail
+// with ENOSYS.
+func (p *Profile) Compile(caps []string) ([]unix.SockFilter, error) {
+	arch := archNames[nativeArch]
+	if len(p.Architectures) > 0 && !contains(p.Architectures, arch) {
+		return nil, fmt.Errorf("profile does not support %s", arch)
+	}
+	defaultRet, err := actionValue(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	held := map[string]bool{}
+	for _, c := range caps {
+		held[c] = true
+	}
+
+	a := newAssembler()
+	enosys := unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)
+	a.load(offArch)
+	a.jump(unix.BPF_JEQ, nativeArch, "native", "")
+	a.ret(enosys)
+	a.mark("native")
+	if nativeArch == unix.AUDIT_ARCH_X86_64 {
+		a.load(offNr)
+		a.jump(unix.BPF_JGE, x32Bit, "", "native64")
+		a.ret(enosys)
+		a.mark("native64")
+	}
+
+	for i := range p.Syscalls {
+		s := &p.Syscalls[i]
+		ret, err := actionValue(s.Action, s.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		if !s.applies(held) {
+			continue
+		}
+		names := s.Names
+		if s.Name != "" {
+			names = append([]string{s.Name}, names...)
+		}
+		var nrs []uint32
+		for _, name := range names {
+			if nr, ok := syscalls[name]; ok {
+				nrs = append(nrs, nr)
+			}
+		}
+		if len(nrs) == 0 {
+			continue
+		}
+		if err := compileRule(a, nrs, s.Args, ret); err != nil {
+			return nil, fmt.Errorf("syscall %s: %v", names[0], err)
+		}
+	}
+	a.ret(defaultRet)
+	return a.assemble()
+}
+
+// compileRule returns ret for the syscalls nrs when all args match
+func compileRule(a *assembler, nrs []uint32, args []Arg, ret uint32) error {
+	match, next := a.newLabel(), a.newLabel()
+	a.load(offNr)
+	// Conditional jumps reach 255 instructions, so long lists are split
+	// into chunks that each jump to the match on a hit
+	const chunk = 128
+	for len(nrs) > 0 {
+		n := len(nrs)
+		if n > chunk {
+			n = chunk
+		}
+		hit, miss := a.newLabel(), a.newLabel()
+		for _, nr := range nrs[:n] {
+			a.jump(unix.BPF_JEQ, nr, hit, "")
+		}
+		a.jumpAlways(miss)
+		a.mark(hit)
+		a.jumpAlways(match)
+		a.mark(miss)
+		nrs = nrs[n:]
+	}
+	a.jumpAlways(next)
+
+	a.mark(match)
+	for _, arg := range args {
+		if err := compileArg(a, arg, next); err != nil {
+			return err
+		}
+	}
+	a.ret(ret)
+	a.mark(next)
+	return nil
+}
+
+// compileArg falls through when arg matches and jumps to fail otherwise.
+// Arguments are 64-bit, compared as high and low words.
+func compileArg(a *assembler, arg Arg, fail string) error {
+	if arg.Index > 5 {
+		return fmt.Errorf("argument index %d out of range", arg.Index)
+	}
+	lo := offArgs + 8*uint32(arg.Index)
+	hi := lo + 4
+	value := arg.Value
+	ok := a.newLabel()
+
+	switch arg.Op {
+	case "SCMP_CMP_EQ", "SCMP_CMP_MASKED_EQ":
+		mask := ^uint64(0)
+		if arg.Op == "SCMP_CMP_MASKED_EQ" {
+			mask, value = arg.Value, arg.ValueTwo
+		}
+		a.load(hi)
+		a.and(uint32(mask >> 32))
+		a.jump(unix.BPF_JEQ, uint32(value>>32), "", fail)
+		a.load(lo)
+		a.and(uint32(mask))
+		a.jump(unix.BPF_JEQ, uint32(value), "", fail)
+	case "SCMP_CMP_NE":
+		a.load(hi)
+		a.jump(unix.BPF_JEQ, uint32(value>>32), "", ok)
+		a.load(lo)
+		a.jump(unix.BPF_JEQ, uint32(value), fail, "")
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		op := uint16(unix.BPF_JGT)
+		if arg.Op == "SCMP_CMP_GE" {
+			op = unix.BPF_JGE
+		}
+		a.load(hi)
+		a.jump(unix.BPF_JGT, uint32(value>>32), ok, "")
+		a.jump(unix.BPF_JEQ, uint32(value>>32), "", fail)
+		a.load(lo)
+		a.jump(op, uint32(value), "", fail)
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		// a < v is not a >= v, and a <= v is not a > v
+		op := uint16(unix.BPF_JGE)
+		if arg.Op == "SCMP_CMP_LE" {
+			op = unix.BPF_JGT
+		}
+		a.load(hi)
+		a.jump(unix.BPF_JGT, uint32(value>>32), fail, "")
+		a.jump(unix.BPF_JEQ, uint32(value>>32), "", ok)
+		a.load(lo)
+		a.jump(op, uint32(value), fail, "")
+	default:
+		return fmt.Errorf("unknown operator %q", arg.Op)
+	}
+	a.mark(ok)
+	return nil
+}
+
+// Install compiles the profile for a container holding caps and applies
+// it to the calling thread. Without no_new_privs this needs CAP_SYS_ADMIN,
+// so call it before dropping capabilities, from the thread that execs.
+func (p *Profile) Install(caps []string) error {
+	filter, err := p.Compile(caps)
+	if err != nil {
+		return fmt.Errorf("invalid seccomp profile: %v", err)
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := unix.RawSyscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, 0, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("cannot install seccomp filter: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package seccomp
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// call is the struct seccomp_data a filter sees
+type call struct {
+	arch uint32
+	nr   uint32
+	args [6]uint64
+}
+
+func syscall(name string, args ...uint64) call {
+	c := call{arch: nativeArch, nr: syscalls[name]}
+	copy(c.args[:], args)
+	return c
+}
+
+// bytes lays c out for the VM. The kernel loads words in host order, the
+// VM in network order, so every word is stored big-endian at the offset
+// where the kernel would find it.
+func (c call) bytes() []byte {
+	b := make([]byte, 64)
+	binary.BigEndian.PutUint32(b[offNr:], c.nr)
+	binary.BigEndian.PutUint32(b[offArch:], c.arch)
+	for i, arg := range c.args {
+		lo := offArgs + 8*i
+		binary.BigEndian.PutUint32(b[lo:], uint32(arg))
+		binary.BigEndian.PutUint32(b[lo+4:], uint32(arg>>32))
+	}
+	return b
+}
+
+// run compiles p for caps and returns what the filter returns for c
+func run(t *testing.T, p *Profile, caps []string, c call) uint32 {
+	t.Helper()
+	filter, err := p.Compile(caps)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	raw := make([]bpf.RawInstruction, len(filter))
+	for i, ins := range filter {
+		raw[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	prog, ok := bpf.Disassemble(raw)
+	if !ok {
+		t.Fatalf("filter does not disassemble")
+	}
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatalf("NewVM: %v", err)
+	}
+	ret, err := vm.Run(c.bytes())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return uint32(ret)
+}
+
+const (
+	allow  = unix.SECCOMP_RET_ALLOW
+	eperm  = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	enoSys = unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)
+)
+
+func TestDefaultProfile(t *testing.T) {
+	admin := []string{"CAP_SYS_ADMIN"}
+	tests := []struct {
+		name string
+		caps []string
+		call call
+		want uint32
+	}{
+		{"getpid", nil, syscall("getpid"), allow},
+		{"mount", nil, syscall("mount"), eperm},
+		{"mount with CAP_SYS_ADMIN", admin, syscall("mount"), allow},
+		{"unshare", nil, syscall("unshare", unix.CLONE_NEWUSER), eperm},
+		{"keyctl with CAP_SYS_ADMIN", admin, syscall("keyctl"), eperm},
+		{"clone thread", nil, syscall("clone", unix.CLONE_VM|unix.CLONE_THREAD|unix.CLONE_SIGHAND), allow},
+		{"clone fork", nil, syscall("clone", uint64(unix.SIGCHLD)), allow},
+		{"clone user namespace", nil, syscall("clone", unix.CLONE_NEWUSER|uint64(unix.SIGCHLD)), eperm},
+		{"clone mount namespace", nil, syscall("clone", unix.CLONE_NEWNS), eperm},
+		{"clone net namespace", nil, syscall("clone", unix.CLONE_NEWNET), eperm},
+		{"clone namespace with CAP_SYS_ADMIN", admin, syscall("clone", unix.CLONE_NEWUSER), allow},
+		{"clone3", nil, syscall("clone3"), enoSys},
+		{"clone3 with CAP_SYS_ADMIN", admin, syscall("clone3"), allow},
+		{"ptrace", nil, syscall("ptrace"), eperm},
+		{"ptrace with CAP_SYS_PTRACE", []string{"CAP_SYS_PTRACE"}, syscall("ptrace"), allow},
+		{"bpf with CAP_BPF", []string{"CAP_BPF"}, syscall("bpf"), allow},
+		{"personality linux", nil, syscall("personality", 0), allow},
+		{"personality query", nil, syscall("personality", 0xffffffff), allow},
+		{"personality other", nil, syscall("personality", 0x0400000), eperm},
+		{"personality high word", nil, syscall("personality", 1<<32), eperm},
+		{"foreign architecture", nil, call{arch: unix.AUDIT_ARCH_I386, nr: syscalls["getpid"]}, enoSys},
+	}
+	if nativeArch == unix.AUDIT_ARCH_X86_64 {
+		tests = append(tests, struct {
+			name string
+			caps []string
+			call call
+			want uint32
+		}{"x32 syscall", nil, call{arch: nativeArch, nr: x32Bit | syscalls["mount"]}, enoSys})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, DefaultProfile, tt.caps, tt.call); got != tt.want {
+				t.Errorf("got %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgComparisons(t *testing.T) {
+	// Values straddle the word boundary so both halves are compared
+	const v = 0x1_0000_0005
+	tests := []struct {
+		op    string
+		value uint64
+		arg   uint64
+		match bool
+	}{
+		{"SCMP_CMP_EQ", v, v, true},
+		{"SCMP_CMP_EQ", v, 0x5, false},
+		{"SCMP_CMP_EQ", v, 0x2_0000_0005, false},
+		{"SCMP_CMP_NE", v, v, false},
+		{"SCMP_CMP_NE", v, 0x5, true},
+		{"SCMP_CMP_NE", v, 0x1_0000_0006, true},
+		{"SCMP_CMP_GT", v, v + 1, true},
+		{"SCMP_CMP_GT", v, v, false},
+		{"SCMP_CMP_GT", v, 0xffff_ffff, false},
+		{"SCMP_CMP_GT", v, 0x2_0000_0000, true},
+		{"SCMP_CMP_GE", v, v, true},
+		{"SCMP_CMP_GE", v, v - 1, false},
+		{"SCMP_CMP_GE", v, 0x2_0000_0000, true},
+		{"SCMP_CMP_LT", v, v - 1, true},
+		{"SCMP_CMP_LT", v, v, false},
+		{"SCMP_CMP_LT", v, 0xffff_ffff, true},
+		{"SCMP_CMP_LT", v, 0x2_0000_0000, false},
+		{"SCMP_CMP_LE", v, v, true},
+		{"SCMP_CMP_LE", v, v + 1, false},
+		{"SCMP_CMP_LE", v, 0x1, true},
+	}
+
+	for _, tt := range tests {
+		p := &Profile{
+			DefaultAction: ActAllow,
+			Syscalls: []Syscall{{
+				Names:  []string{"read"},
+				Action: ActErrno,
+				Args:   []Arg{{Index: 2, Value: tt.value, Op: tt.op}},
+			}},
+		}
+		want := uint32(allow)
+		if tt.match {
+			want = eperm
+		}
+		if got := run(t, p, nil, syscall("read", 0, 0, tt.arg)); got != want {
+			t.Errorf("%s %#x against %#x: got %#x, want %#x", tt.op, tt.value, tt.arg, got, want)
+		}
+	}
+}
+
+func TestMaskedEqual(t *testing.T) {
+	p := &Profile{
+		DefaultAction: ActAllow,
+		Syscalls: []Syscall{{
+			Names:  []string{"read"},
+			Action: ActErrno,
+			Args:   []Arg{{Index: 0, Value: 0xff_0000_00ff, ValueTwo: 0x01_0000_0002, Op: "SCMP_CMP_MASKED_EQ"}},
+		}},
+	}
+	tests := []struct {
+		arg  uint64
+		want uint32
+	}{
+		{0x01_0000_0002, eperm},
+		{0xab01_1234_5602, eperm},
+		{0x02_0000_0002, allow},
+		{0x01_0000_0003, allow},
+	}
+	for _, tt := range tests {
+		if got := run(t, p, nil, syscall("read", tt.arg)); got != tt.want {
+			t.Errorf("arg %#x: got %#x, want %#x", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestMultipleArgs(t *testing.T) {
+	p := &Profile{
+		DefaultAction: ActAllow,
+		Syscalls: []Syscall{{
+			Names:  []string{"write"},
+			Action: ActErrno,
+			Args: []Arg{
+				{Index: 0, Value: 1, Op: "SCMP_CMP_EQ"},
+				{Index: 2, Value: 100, Op: "SCMP_CMP_GT"},
+			},
+		}},
+	}
+	if got := run(t, p, nil, syscall("write", 1, 0, 101)); got != eperm {
+		t.Errorf("both args match: got %#x", got)
+	}
+	if got := run(t, p, nil, syscall("write", 2, 0, 101)); got != allow {
+		t.Errorf("first arg differs: got %#x", got)
+	}
+	if got := run(t, p, nil, syscall("write", 1, 0, 100)); got != allow {
+		t.Errorf("second arg differs: got %#x", got)
+	}
+}
+
+// TestLongRule checks rules with more syscalls than a conditional jump can
+// skip, which are split into chunks
+func TestLongRule(t *testing.T) {
+	var names []string
+	for name := range syscalls {
+		if name != "getpid" {
+			names = append(names, name)
+		}
+	}
+	if len(names) < 300 {
+		t.Fatalf("only %d syscalls in the table", len(names))
+	}
+	p := &Profile{
+		DefaultAction: ActAllow,
+		Syscalls: []Syscall{
+			{Names: names, Action: ActErrno},
+			{Names: []string{"getpid"}, Action: ActTrap},
+		},
+	}
+	for _, name := range []string{names[0], names[127], names[128], names[200], names[len(names)-1]} {
+		if got := run(t, p, nil, syscall(name)); got != eperm {
+			t.Errorf("%s: got %#x, want EPERM", name, got)
+		}
+	}
+	if got := run(t, p, nil, syscall("getpid")); got != unix.SECCOMP_RET_TRAP {
+		t.Errorf("getpid: got %#x, want TRAP", got)
+	}
+}
+
+func TestActions(t *testing.T) {
+	errno := uint(unix.EACCES)
+	defaultErrno := uint(unix.ENOSYS)
+	p := &Profile{
+		DefaultAction:   ActErrno,
+		DefaultErrnoRet: &defaultErrno,
+		Syscalls: []Syscall{
+			{Names: []string{"read"}, Action: ActAllow},
+			{Name: "write", Action: ActErrno, ErrnoRet: &errno},
+			{Names: []string{"open"}, Action: ActErrno},
+			{Names: []string{"close"}, Action: ActKillProcess},
+			{Names: []string{"getpid"}, Action: ActLog},
+			{Names: []string{"no_such_syscall"}, Action: ActKill},
+			{Names: []string{"getuid"}, Action: ActKill, Includes: Filter{Caps: []string{"CAP_KILL", "CAP_CHOWN"}}},
+			{Names: []string{"getgid"}, Action: ActKill, Excludes: Filter{Arches: []string{archNames[nativeArch]}}},
+		},
+	}
+	if nativeArch == unix.AUDIT_ARCH_AARCH64 {
+		p.Syscalls[2].Names = []string{"openat"}
+	}
+	open := p.Syscalls[2].Names[0]
+	tests := []struct {
+		name string
+		caps []string
+		call call
+		want uint32
+	}{
+		{"allow", nil, syscall("read"), allow},
+		{"errno", nil, syscall("write"), unix.SECCOMP_RET_ERRNO | uint32(unix.EACCES)},
+		{"errno default", nil, syscall(open), eperm},
+		{"kill process", nil, syscall("close"), unix.SECCOMP_RET_KILL_PROCESS},
+		{"log", nil, syscall("getpid"), unix.SECCOMP_RET_LOG},
+		{"default action", nil, syscall("getppid"), enoSys},
+		{"includes all caps", []string{"CAP_KILL", "CAP_CHOWN"}, syscall("getuid"), unix.SECCOMP_RET_KILL_THREAD},
+		{"includes missing a cap", []string{"CAP_KILL"}, syscall("getuid"), enoSys},
+		{"excluded arch", nil, syscall("getgid"), enoSys},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(t, p, tt.caps, tt.call); got != tt.want {
+				t.Errorf("got %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogOnly(t *testing.T) {
+	p := DefaultProfile.LogOnly()
+	if got := run(t, p, nil, syscall("mount")); got != unix.SECCOMP_RET_LOG {
+		t.Errorf("mount: got %#x, want LOG", got)
+	}
+	if got := run(t, p, nil, syscall("getpid")); got != allow {
+		t.Errorf("getpid: got %#x, want ALLOW", got)
+	}
+	// The original is left alone
+	if got := run(t, DefaultProfile, nil, syscall("mount")); got != eperm {
+		t.Errorf("default profile changed: mount got %#x", got)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := map[string]*Profile{
+		"unknown default action": {DefaultAction: "SCMP_ACT_NOPE"},
+		"unknown action": {
+			DefaultAction: ActAllow,
+			Syscalls:      []Syscall{{Names: []string{"read"}, Action: "SCMP_ACT_NOPE"}},
+		},
+		"unknown operator": {
+			DefaultAction: ActAllow,
+			Syscalls:      []Syscall{{Names: []string{"read"}, Action: ActErrno, Args: []Arg{{Op: "SCMP_CMP_NOPE"}}}},
+		},
+		"argument index": {
+			DefaultAction: ActAllow,
+			Syscalls:      []Syscall{{Names: []string{"read"}, Action: ActErrno, Args: []Arg{{Index: 6, Op: "SCMP_CMP_EQ"}}}},
+		},
+		"architecture": {DefaultAction: ActAllow, Architectures: []string{"SCMP_ARCH_PPC64LE"}},
+	}
+	for name, p := range tests {
+		if _, err := p.Compile(nil); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.json")
+	os.WriteFile(good, []byte(`{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["mount"],"action":"SCMP_ACT_ERRNO","errnoRet":13}]}`), 0644)
+	p, err := Load(good)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := run(t, p, nil, syscall("mount")); got != unix.SECCOMP_RET_ERRNO|uint32(unix.EACCES) {
+		t.Errorf("mount: got %#x, want EACCES", got)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`{"defaultAction":"SCMP_ACT_NOPE"}`), 0644)
+	if _, err := Load(bad); err == nil {
+		t.Errorf("Load accepted an unknown action")
+	}
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("Load accepted a missing file")
+	}
+}
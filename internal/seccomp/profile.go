@@ -0,0 +1,203 @@
+// Package seccomp compiles Docker/OCI style seccomp profiles to classic BPF
+// and installs them
+package seccomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Action is what the kernel does when a rule matches
+type Action string
+
+// Actions understood in profiles
+const (
+	ActKill        Action = "SCMP_ACT_KILL"
+	ActKillThread  Action = "SCMP_ACT_KILL_THREAD"
+	ActKillProcess Action = "SCMP_ACT_KILL_PROCESS"
+	ActTrap        Action = "SCMP_ACT_TRAP"
+	ActErrno       Action = "SCMP_ACT_ERRNO"
+	ActTrace       Action = "SCMP_ACT_TRACE"
+	ActLog         Action = "SCMP_ACT_LOG"
+	ActAllow       Action = "SCMP_ACT_ALLOW"
+)
+
+// Profile is a seccomp profile in the format used by Docker and the OCI
+// runtime spec
+type Profile struct {
+	DefaultAction   Action    `json:"defaultAction"`
+	DefaultErrnoRet *uint     `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string  `json:"architectures,omitempty"`
+	Syscalls        []Syscall `json:"syscalls,omitempty"`
+}
+
+// Syscall is a rule for one or more syscalls
+type Syscall struct {
+	Names    []string `json:"names,omitempty"`
+	Name     string   `json:"name,omitempty"` // older single-name form
+	Action   Action   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []Arg    `json:"args,omitempty"`
+	Includes Filter   `json:"includes,omitempty"`
+	Excludes Filter   `json:"excludes,omitempty"`
+}
+
+// Arg compares a syscall argument; all of a rule's args must match
+type Arg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// Filter limits a rule to containers with (includes) or without
+// (excludes) any of the capabilities, on the listed architectures
+type Filter struct {
+	Caps   []string `json:"caps,omitempty"`
+	Arches []string `json:"arches,omitempty"`
+}
+
+// Load reads a profile from a JSON file
+func Load(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read seccomp profile: %v", err)
+	}
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %v", path, err)
+	}
+	if _, err := p.Compile(nil); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %v", path, err)
+	}
+	return &p, nil
+}
+
+// LogOnly returns a copy of p that logs what p would block instead of
+// blocking it, for finding out which syscalls a workload needs
+func (p *Profile) LogOnly() *Profile {
+	logged := *p
+	if logged.DefaultAction != ActAllow {
+		logged.DefaultAction = ActLog
+	}
+	logged.Syscalls = nil
+	for _, s := range p.Syscalls {
+		if s.Action != ActAllow {
+			s.Action = ActLog
+		}
+		logged.Syscalls = append(logged.Syscalls, s)
+	}
+	return &logged
+}
+
+// cloneNamespaceFlags are the clone flags that create namespaces
+const cloneNamespaceFlags = unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP | unix.CLONE_NEWUTS |
+	unix.CLONE_NEWIPC | unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET
+
+var enosys = uint(unix.ENOSYS)
+
+// DefaultProfile allows everything except syscalls that reach outside the
+// container: kernel modules, kexec, clocks, keyrings, mounts and new
+// namespaces, whether from unshare, setns or clone. Most are allowed again
+// when the container holds the capability that guards them.
+var DefaultProfile = &Profile{
+	DefaultAction: ActAllow,
+	Syscalls: []Syscall{
+		{
+			Names: []string{
+				"acct", "add_key", "get_kernel_syms", "keyctl", "kexec_file_load",
+				"kexec_load", "lookup_dcookie", "nfsservctl", "query_module",
+				"request_key", "uselib", "userfaultfd", "ustat", "_sysctl",
+				"create_module", "vm86", "vm86old",
+			},
+			Action: ActErrno,
+		},
+		{
+			Names:    []string{"init_module", "finit_module", "delete_module"},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_SYS_MODULE"}},
+		},
+		{
+			Names:    []string{"reboot"},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_SYS_BOOT"}},
+		},
+		{
+			Names:    []string{"clock_adjtime", "clock_settime", "settimeofday", "stime", "adjtimex"},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_SYS_TIME"}},
+		},
+		{
+			Names:    []string{"ptrace", "process_vm_readv", "process_vm_writev", "kcmp"},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_SYS_PTRACE"}},
+		},
+		{
+			Names:    []string{"ioperm", "iopl"},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_SYS_RAWIO"}},
+		},
+		{
+			Names:    []string{"open_by_handle_at"},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_DAC_READ_SEARCH"}},
+		},
+		{
+			Names:    []string{"bpf", "perf_event_open"},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_SYS_ADMIN", "CAP_BPF", "CAP_PERFMON"}},
+		},
+		{
+			Names: []string{
+				"mount", "umount", "umount2", "pivot_root", "fsopen", "fsconfig",
+				"fsmount", "fspick", "move_mount", "open_tree", "mount_setattr",
+				"setns", "unshare", "swapon", "swapoff", "quotactl", "quotactl_fd",
+				"name_to_handle_at", "syslog", "sethostname", "setdomainname",
+				"lookup_dcookie", "fanotify_init",
+			},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_SYS_ADMIN"}},
+		},
+		{
+			// clone may not create namespaces: none of CLONE_NEWNS,
+			// NEWCGROUP, NEWUTS, NEWIPC, NEWUSER, NEWPID or NEWNET
+			Names:    []string{"clone"},
+			Action:   ActAllow,
+			Args:     []Arg{{Index: 0, Value: cloneNamespaceFlags, ValueTwo: 0, Op: "SCMP_CMP_MASKED_EQ"}},
+			Excludes: Filter{Caps: []string{"CAP_SYS_ADMIN"}},
+		},
+		{
+			Names:    []string{"clone"},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_SYS_ADMIN"}},
+		},
+		{
+			// clone3 passes its flags in memory the filter cannot read.
+			// ENOSYS makes libc fall back to clone.
+			Names:    []string{"clone3"},
+			Action:   ActErrno,
+			ErrnoRet: &enosys,
+			Excludes: Filter{Caps: []string{"CAP_SYS_ADMIN"}},
+		},
+		{
+			Names:    []string{"get_mempolicy", "mbind", "set_mempolicy", "move_pages"},
+			Action:   ActErrno,
+			Excludes: Filter{Caps: []string{"CAP_SYS_NICE"}},
+		},
+		{
+			// personality is allowed for the usual execution domains only
+			Names:  []string{"personality"},
+			Action: ActErrno,
+			Args: []Arg{
+				{Index: 0, Value: 0x0, Op: "SCMP_CMP_NE"},
+				{Index: 0, Value: 0x8, Op: "SCMP_CMP_NE"},
+				{Index: 0, Value: 0x20000, Op: "SCMP_CMP_NE"},
+				{Index: 0, Value: 0x20008, Op: "SCMP_CMP_NE"},
+				{Index: 0, Value: 0xffffffff, Op: "SCMP_CMP_NE"},
+			},
+		},
+	},
+}
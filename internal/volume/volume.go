@@ -0,0 +1,145 @@
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"gocount/internal/paths"
+)
+
+// Root is where named volumes are stored
+var Root = filepath.Join(paths.Root, "volumes")
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Volume is a named directory that outlives the containers using it
+type Volume struct {
+	Name    string
+	Created time.Time
+}
+
+// ValidName reports whether name can be used for a volume
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Dir returns the directory holding the volume's metadata and data
+func (v *Volume) Dir() string {
+	return filepath.Join(Root, v.Name)
+}
+
+// Mountpoint returns the directory that is mounted into containers
+func (v *Volume) Mountpoint() string {
+	return filepath.Join(v.Dir(), "_data")
+}
+
+// IsEmpty reports whether the volume holds no files yet
+func (v *Volume) IsEmpty() bool {
+	entries, err := os.ReadDir(v.Mountpoint())
+	return err == nil && len(entries) == 0
+}
+
+// Create makes a new, empty volume
+func Create(name string) (*Volume, error) {
+	if !ValidName(name) {
+		return nil, fmt.Errorf("invalid volume name: %q", name)
+	}
+	v := &Volume{Name: name, Created: time.Now()}
+	if err := os.MkdirAll(Root, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(v.Dir(), 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("volume already exists: %s", name)
+		}
+		return nil, err
+	}
+	if err := os.Mkdir(v.Mountpoint(), 0755); err != nil {
+		return nil, err
+	}
+
+	data, _ := json.MarshalIndent(v, "", "  ")
+	if err := os.WriteFile(filepath.Join(v.Dir(), "volume.json"), data, 0644); err != nil {
+		os.RemoveAll(v.Dir())
+		return nil, err
+	}
+	return v, nil
+}
+
+// Get loads the volume called name
+func Get(name string) (*Volume, error) {
+	if !ValidName(name) {
+		return nil, fmt.Errorf("invalid volume name: %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(Root, name, "volume.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("volume not found: %s", name)
+		}
+		return nil, err
+	}
+	var v Volume
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("invalid metadata for volume %s: %v", name, err)
+	}
+	return &v, nil
+}
+
+// Ensure returns the volume called name, creating it if needed
+func Ensure(name string) (*Volume, error) {
+	v, err := Get(name)
+	if err == nil {
+		return v, nil
+	}
+	if v, err = Create(name); err == nil {
+		return v, nil
+	}
+	// Created concurrently by another container
+	if v, gerr := Get(name); gerr == nil {
+		return v, nil
+	}
+	return nil, err
+}
+
+// List returns all volumes sorted by name
+func List() ([]*Volume, error) {
+	entries, err := os.ReadDir(Root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var volumes []*Volume
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		v, err := Get(e.Name())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			continue
+		}
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// Remove deletes the volume and its data
+func Remove(name string) error {
+	v, err := Get(name)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(v.Dir()); err != nil {
+		return fmt.Errorf("failed to remove volume %s: %v", name, err)
+	}
+	return nil
+}